@@ -0,0 +1,104 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
+)
+
+const contentTypeCertificateChain = "application/pem-certificate-chain"
+
+type certificateRequest struct {
+	CommonName   string `json:"common_name,omitempty"` // defaults to the device ID
+	Organization string `json:"organization,omitempty"`
+	ValidityDays int    `json:"validity_days,omitempty"` // self-signed certificates only
+}
+
+func (r certificateRequest) params() service.CertificateParams {
+	return service.CertificateParams{
+		CommonName:   r.CommonName,
+		Organization: r.Organization,
+		Validity:     time.Duration(r.ValidityDays) * 24 * time.Hour,
+	}
+}
+
+type uploadCertificateRequest struct {
+	CertificateChain string `json:"certificate_chain"` // PEM encoded, the device's certificate first
+}
+
+type certificateResponse struct {
+	CertificateChain string `json:"certificate_chain"`
+}
+
+type certificateSigningRequestResponse struct {
+	CSR string `json:"csr"` // PEM encoded PKCS#10
+}
+
+// IssueCertificate issues a self-signed certificate for the device key and stores it
+// as the device's certificate chain.
+func (s *Server) IssueCertificate(w http.ResponseWriter, r *http.Request) {
+	var req certificateRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	chain, err := s.devices.IssueSelfSignedCertificate(r.PathValue("id"), req.params())
+	if err != nil {
+		writeServiceError(w, err, "Failed to issue certificate")
+		return
+	}
+
+	WriteAPIResponse(w, http.StatusCreated, certificateResponse{CertificateChain: string(chain)})
+}
+
+// CreateCertificateSigningRequest creates a PKCS#10 request to have the device key certified by a CA.
+func (s *Server) CreateCertificateSigningRequest(w http.ResponseWriter, r *http.Request) {
+	var req certificateRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	csr, err := s.devices.CreateCertificateRequest(r.PathValue("id"), req.params())
+	if err != nil {
+		writeServiceError(w, err, "Failed to create certificate signing request")
+		return
+	}
+
+	WriteAPIResponse(w, http.StatusOK, certificateSigningRequestResponse{CSR: string(csr)})
+}
+
+// UploadCertificate stores the certificate chain a CA issued for the device key.
+func (s *Server) UploadCertificate(w http.ResponseWriter, r *http.Request) {
+	var req uploadCertificateRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := s.devices.UploadCertificateChain(id, []byte(req.CertificateChain)); err != nil {
+		writeServiceError(w, err, "Failed to upload certificate")
+		return
+	}
+
+	chain, err := s.devices.GetCertificateChain(id)
+	if err != nil {
+		writeServiceError(w, err, "Failed to upload certificate")
+		return
+	}
+
+	WriteAPIResponse(w, http.StatusOK, certificateResponse{CertificateChain: string(chain)})
+}
+
+// GetCertificate returns the device's certificate chain as PEM.
+func (s *Server) GetCertificate(w http.ResponseWriter, r *http.Request) {
+	chain, err := s.devices.GetCertificateChain(r.PathValue("id"))
+	if err != nil {
+		writeServiceError(w, err, "Failed to get certificate")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeCertificateChain)
+	w.WriteHeader(http.StatusOK)
+	w.Write(chain)
+}
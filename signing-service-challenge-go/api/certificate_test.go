@@ -0,0 +1,168 @@
+package api_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/api"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+func postCertificate(t *testing.T, server *api.Server, method, target string, body interface{}, expectedStatus int) map[string]interface{} {
+	t.Helper()
+	reqBody, _ := json.Marshal(body)
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest(method, target, bytes.NewReader(reqBody)))
+	require.Equal(t, expectedStatus, rr.Code, rr.Body.String())
+	if expectedStatus/100 != 2 {
+		return nil
+	}
+
+	var resp api.Response
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	return resp.Data.(map[string]interface{})
+}
+
+func getCertificate(t *testing.T, server *api.Server, deviceID string, expectedStatus int) []*x509.Certificate {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v0/devices/"+deviceID+"/certificate", nil))
+	require.Equal(t, expectedStatus, rr.Code, rr.Body.String())
+	if expectedStatus != http.StatusOK {
+		return nil
+	}
+	assert.Equal(t, "application/pem-certificate-chain", rr.Header().Get("Content-Type"))
+
+	var certificates []*x509.Certificate
+	for rest := rr.Body.Bytes(); ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		certificates = append(certificates, certificate)
+	}
+	return certificates
+}
+
+func devicePublicKey(t *testing.T, server *api.Server, deviceID string) interface{} {
+	t.Helper()
+	rr := getPublicKey(t, server, deviceID, "application/octet-stream", http.StatusOK)
+	publicKey, err := x509.ParsePKIXPublicKey(rr.Body.Bytes())
+	require.NoError(t, err)
+	return publicKey
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	forEachStore(t, testSelfSignedCertificate)
+}
+
+func testSelfSignedCertificate(t *testing.T, store persistence.DeviceStore) {
+	server := newServer(store)
+	createDevice(t, server, "00000000-0000-4000-8000-000000000001", domain.AlgorithmECC, "Till 1")
+
+	getCertificate(t, server, "00000000-0000-4000-8000-000000000001", http.StatusNotFound)
+
+	data := postCertificate(t, server, "POST", "/api/v0/devices/00000000-0000-4000-8000-000000000001/certificate",
+		map[string]interface{}{"organization": "Shop", "validity_days": 30}, http.StatusCreated)
+	assert.Contains(t, data["certificate_chain"], "-----BEGIN CERTIFICATE-----")
+
+	certificates := getCertificate(t, server, "00000000-0000-4000-8000-000000000001", http.StatusOK)
+	require.Len(t, certificates, 1)
+	certificate := certificates[0]
+	assert.Equal(t, "00000000-0000-4000-8000-000000000001", certificate.Subject.CommonName)
+	assert.Equal(t, []string{"Shop"}, certificate.Subject.Organization)
+	assert.WithinDuration(t, certificate.NotBefore.Add(30*24*time.Hour), certificate.NotAfter, time.Second)
+	assert.True(t, certificate.PublicKey.(*ecdsa.PublicKey).Equal(devicePublicKey(t, server, "00000000-0000-4000-8000-000000000001")))
+	assert.NoError(t, certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature))
+
+	postCertificate(t, server, "POST", "/api/v0/devices/00000000-0000-4000-8000-000000000001/certificate",
+		map[string]interface{}{"validity_days": -1}, http.StatusBadRequest)
+	postCertificate(t, server, "POST", "/api/v0/devices/unknown/certificate",
+		map[string]interface{}{}, http.StatusNotFound)
+}
+
+func TestCertificateSigningRequest(t *testing.T) {
+	server := newServer(persistence.NewInMemoryDeviceStore())
+	createDevice(t, server, "00000000-0000-4000-8000-000000000001", domain.AlgorithmRSA, "Till 1")
+
+	data := postCertificate(t, server, "POST", "/api/v0/devices/00000000-0000-4000-8000-000000000001/certificate/csr",
+		map[string]interface{}{"common_name": "Till 1"}, http.StatusOK)
+	block, _ := pem.Decode([]byte(data["csr"].(string)))
+	require.NotNil(t, block)
+	assert.Equal(t, "CERTIFICATE REQUEST", block.Type)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	assert.NoError(t, csr.CheckSignature())
+	assert.Equal(t, "Till 1", csr.Subject.CommonName)
+
+	// A CA certifies the request and the chain is uploaded.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, csr.PublicKey, caKey)
+	require.NoError(t, err)
+
+	leafPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+
+	t.Run("Upload", func(t *testing.T) {
+		postCertificate(t, server, "PUT", "/api/v0/devices/00000000-0000-4000-8000-000000000001/certificate",
+			map[string]string{"certificate_chain": string(leafPEM) + string(caPEM)}, http.StatusOK)
+
+		certificates := getCertificate(t, server, "00000000-0000-4000-8000-000000000001", http.StatusOK)
+		require.Len(t, certificates, 2)
+		assert.Equal(t, "Till 1", certificates[0].Subject.CommonName)
+		assert.Equal(t, "Test CA", certificates[1].Subject.CommonName)
+	})
+
+	t.Run("Invalid chains", func(t *testing.T) {
+		createDevice(t, server, "00000000-0000-4000-8000-000000000002", domain.AlgorithmRSA, "Till 2")
+		for name, chain := range map[string]string{
+			"not PEM":           "not PEM",
+			"other device key":  string(leafPEM),
+			"wrong order":       string(caPEM) + string(leafPEM),
+			"CA is not the key": string(caPEM),
+		} {
+			t.Run(name, func(t *testing.T) {
+				postCertificate(t, server, "PUT", "/api/v0/devices/00000000-0000-4000-8000-000000000002/certificate",
+					map[string]string{"certificate_chain": chain}, http.StatusBadRequest)
+			})
+		}
+		getCertificate(t, server, "00000000-0000-4000-8000-000000000002", http.StatusNotFound)
+	})
+}
@@ -1,78 +1,99 @@
 package api
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rsa"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
 	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
 )
 
 type createSignatureDeviceRequest struct {
-	ID        string `json:"id"` // Could be a UUID
-	Algorithm string `json:"algorithm"`
+	ID        string `json:"id,omitempty"` // UUID, generated if omitted
+	Algorithm string `json:"algorithm"`    // ECC, RSA or ED25519
 	Label     string `json:"label,omitempty"`
+	KeySize   int    `json:"key_size,omitempty"` // bits, defaults to 2048 for RSA and 384 for ECC
+	Curve     string `json:"curve,omitempty"`    // ECC only, alternative to key_size: P-256, P-384 or P-521
+	Scheme    string `json:"scheme,omitempty"`   // like RSA_PSS_SHA256 or ECDSA_P384_SHA384, defaults to PKCS#1 v1.5 or ECDSA with SHA-256
+
+	TransactionSchema string `json:"transaction_schema,omitempty"` // like RECEIPT, transactions are free-form if omitted
 }
 
 type createSignatureDeviceResponse struct {
 	ID        string `json:"id"`
 	Algorithm string `json:"algorithm"`
 	Label     string `json:"label,omitempty"`
+	KeySize   int    `json:"key_size"`
+	Curve     string `json:"curve,omitempty"`
+	Scheme    string `json:"scheme"`
 	PublicKey string `json:"public_key"` // base64 encoded
+
+	TransactionSchema string `json:"transaction_schema,omitempty"`
+}
+
+// deviceResponse is the public representation of a signature device.
+// The private key is deliberately not part of it.
+type deviceResponse struct {
+	ID               string `json:"id"`
+	Algorithm        string `json:"algorithm"`
+	Label            string `json:"label,omitempty"`
+	KeySize          int    `json:"key_size,omitempty"` // unknown for devices created before it was recorded
+	Curve            string `json:"curve,omitempty"`
+	Scheme           string `json:"scheme"`
+	Status           string `json:"status"`     // ACTIVE, SUSPENDED or DECOMMISSIONED
+	PublicKey        string `json:"public_key"` // base64 encoded
+	SignatureCounter uint64 `json:"signature_counter"`
+	LastSignature    string `json:"last_signature,omitempty"`
+	KeyVersion       int    `json:"key_version"`
+
+	KeyVersions       []keyVersionResponse `json:"key_versions"`
+	TransactionSchema string               `json:"transaction_schema,omitempty"` // transactions are free-form if empty
+}
+
+// keyVersionResponse is a key a device signed or signs with. The key signs the counters
+// from from_counter on, up to the from_counter of the next version.
+type keyVersionResponse struct {
+	Version       int        `json:"version"`
+	PublicKey     string     `json:"public_key"` // base64 encoded
+	Scheme        string     `json:"scheme"`
+	FromCounter   uint64     `json:"from_counter"`
+	LinkSignature string     `json:"link_signature,omitempty"` // base64 encoded signature of the previous key over public_key
+	CreatedAt     *time.Time `json:"created_at,omitempty"`     // unknown for keys created before versions were recorded
 }
 
+// updateSignatureDeviceRequest changes the fields that are present and leaves the others as they are.
+type updateSignatureDeviceRequest struct {
+	Label  *string `json:"label,omitempty"`
+	Status *string `json:"status,omitempty"` // ACTIVE, SUSPENDED or DECOMMISSIONED
+}
+
+type listDevicesResponse struct {
+	Devices    []deviceResponse `json:"devices"`
+	NextCursor string           `json:"next_cursor,omitempty"` // opaque, pass as "cursor" to get the next page
+}
+
+// CreateSignatureDevice creates a device with a new key. Repeating the request for the same ID
+// returns the existing device with 200 instead of 201, as long as the parameters are the same.
 func (s *Server) CreateSignatureDevice(w http.ResponseWriter, r *http.Request) {
 	var req createSignatureDeviceRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		WriteErrorResponse(w, http.StatusInternalServerError, []string{"decoding request: " + err.Error()})
+	if !decodeRequest(w, r, &req) {
 		return
 	}
 
-	var (
-		publicKey  []byte
-		privateKey []byte
-	)
-
-	switch req.Algorithm {
-	case domain.AlgorithmECC:
-		generator := crypt.ECCGenerator{}
-		keypair, err := generator.Generate()
-		if err != nil {
-			WriteErrorResponse(w, http.StatusInternalServerError, []string{"ecc key generation failed: " + err.Error()})
-			return
-		}
-		publicKey = marshalECCPublicKey(keypair.Public)
-		privateKey = marshalECCPrivateKey(keypair.Private)
-
-	case domain.AlgorithmRSA:
-		generator := crypt.RSAGenerator{}
-		keypair, err := generator.Generate()
-		if err != nil {
-			WriteErrorResponse(w, http.StatusInternalServerError, []string{"rsa key generation failed: " + err.Error()})
-			return
-		}
-		publicKey = marshalRSAPublicKey(keypair.Public)
-		privateKey = marshalRSAPrivateKey(keypair.Private)
-
-	default:
-		WriteErrorResponse(w, http.StatusBadRequest, []string{"Unsupported algorithm"})
-		return
-	}
-
-	device := domain.SignatureDevice{
-		ID:         req.ID,
-		Algorithm:  req.Algorithm,
-		Label:      req.Label,
-		PublicKey:  publicKey,
-		PrivateKey: privateKey,
-	}
-	if err := s.store.Create(device); err != nil {
-		WriteErrorResponse(w, http.StatusInternalServerError, []string{"Failed to create device"})
+	device, created, err := s.devices.CreateDevice(service.CreateDeviceParams{
+		ID:        req.ID,
+		Algorithm: req.Algorithm,
+		Label:     req.Label,
+		KeySize:   req.KeySize,
+		Curve:     req.Curve,
+		Scheme:    req.Scheme,
+
+		TransactionSchema: req.TransactionSchema,
+	})
+	if err != nil {
+		writeServiceError(w, err, "Failed to create device")
 		return
 	}
 
@@ -80,26 +101,144 @@ func (s *Server) CreateSignatureDevice(w http.ResponseWriter, r *http.Request) {
 		ID:        device.ID,
 		Algorithm: device.Algorithm,
 		Label:     device.Label,
+		KeySize:   device.KeySize,
+		Curve:     service.CurveName(device),
+		Scheme:    service.DeviceScheme(device),
 		PublicKey: base64.StdEncoding.EncodeToString(device.PublicKey),
+
+		TransactionSchema: device.TransactionSchema,
 	}
 
-	WriteAPIResponse(w, http.StatusCreated, response)
+	code := http.StatusCreated
+	if !created {
+		code = http.StatusOK
+	}
+	WriteAPIResponse(w, code, response)
 }
 
-func marshalECCPublicKey(pub *ecdsa.PublicKey) []byte {
-	return elliptic.Marshal(pub.Curve, pub.X, pub.Y)
+func newDeviceResponse(device domain.SignatureDevice) deviceResponse {
+	response := deviceResponse{
+		ID:               device.ID,
+		Algorithm:        device.Algorithm,
+		Label:            device.Label,
+		KeySize:          device.KeySize,
+		Curve:            service.CurveName(device),
+		Scheme:           service.DeviceScheme(device),
+		Status:           service.DeviceStatus(device),
+		PublicKey:        base64.StdEncoding.EncodeToString(device.PublicKey),
+		SignatureCounter: device.SignatureCounter,
+		LastSignature:    device.LastSignature,
+
+		TransactionSchema: device.TransactionSchema,
+	}
+
+	for _, version := range service.KeyVersions(device) {
+		response.KeyVersion = version.Version
+		response.KeyVersions = append(response.KeyVersions, newKeyVersionResponse(version))
+	}
+	return response
 }
 
-func marshalECCPrivateKey(priv *ecdsa.PrivateKey) []byte {
-	keyBytes, _ := x509.MarshalECPrivateKey(priv)
-	return keyBytes
+func newKeyVersionResponse(version domain.KeyVersion) keyVersionResponse {
+	response := keyVersionResponse{
+		Version:       version.Version,
+		PublicKey:     base64.StdEncoding.EncodeToString(version.PublicKey),
+		Scheme:        version.Scheme,
+		FromCounter:   version.FromCounter,
+		LinkSignature: version.LinkSignature,
+	}
+	if !version.CreatedAt.IsZero() {
+		response.CreatedAt = &version.CreatedAt
+	}
+	return response
 }
 
-func marshalRSAPublicKey(pub *rsa.PublicKey) []byte {
-	keyBytes, _ := x509.MarshalPKIXPublicKey(pub)
-	return keyBytes
+// GetSignatureDevice returns a single device by its ID.
+func (s *Server) GetSignatureDevice(w http.ResponseWriter, r *http.Request) {
+	device, err := s.devices.GetDevice(r.PathValue("id"))
+	if err != nil {
+		writeServiceError(w, err, "Failed to get device")
+		return
+	}
+
+	WriteAPIResponse(w, http.StatusOK, newDeviceResponse(device))
 }
 
-func marshalRSAPrivateKey(priv *rsa.PrivateKey) []byte {
-	return x509.MarshalPKCS1PrivateKey(priv)
+// UpdateSignatureDevice changes the label or the lifecycle state of a device.
+// Decommissioning a device destroys its private key.
+func (s *Server) UpdateSignatureDevice(w http.ResponseWriter, r *http.Request) {
+	var req updateSignatureDeviceRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	device, err := s.devices.UpdateDevice(r.PathValue("id"), service.UpdateDeviceParams{
+		Label:  req.Label,
+		Status: req.Status,
+	})
+	if err != nil {
+		writeServiceError(w, err, "Failed to update device")
+		return
+	}
+
+	WriteAPIResponse(w, http.StatusOK, newDeviceResponse(device))
+}
+
+// RotateKey replaces the device key with a fresh one, linked to the old key by a signature of
+// the old key over the new public key. The signature counter and chain continue.
+func (s *Server) RotateKey(w http.ResponseWriter, r *http.Request) {
+	device, err := s.devices.RotateKey(r.PathValue("id"))
+	if err != nil {
+		writeServiceError(w, err, "Failed to rotate key")
+		return
+	}
+
+	WriteAPIResponse(w, http.StatusOK, newDeviceResponse(device))
+}
+
+// ListSignatureDevices pages through the devices ordered by ID.
+// Supported query parameters are limit, cursor, algorithm and label_prefix.
+func (s *Server) ListSignatureDevices(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit, ok := parseLimit(w, query.Get("limit"))
+	if !ok {
+		return
+	}
+
+	page, err := s.devices.ListDevices(service.ListDevicesParams{
+		Cursor:      query.Get("cursor"),
+		Limit:       limit,
+		Algorithm:   query.Get("algorithm"),
+		LabelPrefix: query.Get("label_prefix"),
+	})
+	if err != nil {
+		writeServiceError(w, err, "Failed to list devices")
+		return
+	}
+
+	response := listDevicesResponse{
+		Devices:    make([]deviceResponse, 0, len(page.Devices)),
+		NextCursor: page.NextCursor,
+	}
+	for _, device := range page.Devices {
+		response.Devices = append(response.Devices, newDeviceResponse(device))
+	}
+
+	WriteAPIResponse(w, http.StatusOK, response)
+}
+
+// parseLimit parses the page size requested by a client, 0 if none was requested.
+// It writes an error response and returns false if the limit is not a number.
+func parseLimit(w http.ResponseWriter, raw string) (int, bool) {
+	if raw == "" {
+		return 0, true
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 {
+		WriteErrorResponse(w, http.StatusBadRequest, []string{"limit must be a positive integer"})
+		return 0, false
+	}
+	return limit, true
 }
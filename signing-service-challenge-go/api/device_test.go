@@ -0,0 +1,252 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/api"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+func createDevice(t *testing.T, server *api.Server, id, algorithm, label string) {
+	t.Helper()
+	reqBody, _ := json.Marshal(map[string]string{
+		"id":        id,
+		"algorithm": algorithm,
+		"label":     label,
+	})
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices", bytes.NewReader(reqBody)))
+	require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+}
+
+func getData(t *testing.T, server *api.Server, target string, expectedStatus int) map[string]interface{} {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	require.Equal(t, expectedStatus, rr.Code, rr.Body.String())
+	if expectedStatus != http.StatusOK {
+		return nil
+	}
+
+	var resp api.Response
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	data, ok := resp.Data.(map[string]interface{})
+	require.True(t, ok, "response data should be a map")
+	return data
+}
+
+func deviceIDs(data map[string]interface{}) []string {
+	var ids []string
+	for _, device := range data["devices"].([]interface{}) {
+		ids = append(ids, device.(map[string]interface{})["id"].(string))
+	}
+	return ids
+}
+
+func TestGetSignatureDevice(t *testing.T) {
+	forEachStore(t, testGetSignatureDevice)
+}
+
+func testGetSignatureDevice(t *testing.T, store persistence.DeviceStore) {
+	server := newServer(store)
+	createDevice(t, server, "00000000-0000-4000-8000-000000000001", domain.AlgorithmECC, "Till 1")
+
+	data := getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-000000000001", http.StatusOK)
+	assert.Equal(t, "00000000-0000-4000-8000-000000000001", data["id"])
+	assert.Equal(t, domain.AlgorithmECC, data["algorithm"])
+	assert.Equal(t, "Till 1", data["label"])
+	assert.Equal(t, float64(384), data["key_size"])
+	assert.Equal(t, "P-384", data["curve"])
+	assert.NotEmpty(t, data["public_key"])
+	assert.Equal(t, float64(0), data["signature_counter"])
+	assert.NotContains(t, data, "private_key")
+
+	getData(t, server, "/api/v0/devices/unknown", http.StatusNotFound)
+}
+
+func TestCreateSignatureDeviceKeySize(t *testing.T) {
+	server := newServer(persistence.NewInMemoryDeviceStore())
+
+	tests := []struct {
+		name            string
+		body            string
+		expectedStatus  int
+		expectedKeySize float64
+		expectedCurve   string // empty if the response has no curve
+	}{
+		{name: "ECC curve", body: `{"algorithm": "ECC", "curve": "P-256"}`, expectedStatus: http.StatusCreated, expectedKeySize: 256, expectedCurve: "P-256"},
+		{name: "RSA key size", body: `{"algorithm": "RSA", "key_size": 3072}`, expectedStatus: http.StatusCreated, expectedKeySize: 3072},
+		{name: "RSA 512 is rejected", body: `{"algorithm": "RSA", "key_size": 512}`, expectedStatus: http.StatusBadRequest},
+		{name: "Unknown curve", body: `{"algorithm": "ECC", "curve": "secp256k1"}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices", bytes.NewBufferString(tt.body)))
+			require.Equal(t, tt.expectedStatus, rr.Code, rr.Body.String())
+			if tt.expectedStatus != http.StatusCreated {
+				return
+			}
+
+			var resp api.Response
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+			data := resp.Data.(map[string]interface{})
+			assert.Equal(t, tt.expectedKeySize, data["key_size"])
+			if tt.expectedCurve != "" {
+				assert.Equal(t, tt.expectedCurve, data["curve"])
+			} else {
+				assert.NotContains(t, data, "curve")
+			}
+		})
+	}
+}
+
+func TestCreateSignatureDevice(t *testing.T) {
+	forEachStore(t, testCreateSignatureDevice)
+}
+
+func testCreateSignatureDevice(t *testing.T, store persistence.DeviceStore) {
+	server := newServer(store)
+
+	create := func(body string, expectedStatus int) map[string]interface{} {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices", bytes.NewBufferString(body)))
+		require.Equal(t, expectedStatus, rr.Code, rr.Body.String())
+
+		var resp api.Response
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		data, _ := resp.Data.(map[string]interface{})
+		return data
+	}
+
+	generated := create(`{"algorithm": "ECC"}`, http.StatusCreated)
+	_, err := uuid.Parse(generated["id"].(string))
+	assert.NoError(t, err, "the server generates a UUID")
+
+	body := `{"id": "00000000-0000-4000-8000-000000000001", "algorithm": "ECC", "label": "Till 1"}`
+	first := create(body, http.StatusCreated)
+	assert.Equal(t, first, create(body, http.StatusOK), "a retry returns the existing device")
+
+	create(`{"id": "00000000-0000-4000-8000-000000000001", "algorithm": "RSA", "label": "Till 1"}`, http.StatusConflict)
+	create(`{"id": "till-1", "algorithm": "ECC"}`, http.StatusBadRequest)
+}
+
+func TestListSignatureDevices(t *testing.T) {
+	forEachStore(t, testListSignatureDevices)
+}
+
+func testListSignatureDevices(t *testing.T, store persistence.DeviceStore) {
+	server := newServer(store)
+	createDevice(t, server, "00000000-0000-4000-8000-000000000001", domain.AlgorithmECC, "Till 1")
+	createDevice(t, server, "00000000-0000-4000-8000-000000000002", domain.AlgorithmRSA, "Till 2")
+	createDevice(t, server, "00000000-0000-4000-8000-000000000003", domain.AlgorithmECC, "Kiosk")
+
+	t.Run("Pages through all devices", func(t *testing.T) {
+		first := getData(t, server, "/api/v0/devices?limit=2", http.StatusOK)
+		assert.Equal(t, []string{"00000000-0000-4000-8000-000000000001", "00000000-0000-4000-8000-000000000002"}, deviceIDs(first))
+		require.NotEmpty(t, first["next_cursor"])
+
+		second := getData(t, server, "/api/v0/devices?limit=2&cursor="+first["next_cursor"].(string), http.StatusOK)
+		assert.Equal(t, []string{"00000000-0000-4000-8000-000000000003"}, deviceIDs(second))
+		assert.NotContains(t, second, "next_cursor")
+	})
+
+	t.Run("Filters by algorithm and label prefix", func(t *testing.T) {
+		data := getData(t, server, "/api/v0/devices?algorithm=ECC", http.StatusOK)
+		assert.Equal(t, []string{"00000000-0000-4000-8000-000000000001", "00000000-0000-4000-8000-000000000003"}, deviceIDs(data))
+
+		data = getData(t, server, "/api/v0/devices?algorithm=ECC&label_prefix=Till", http.StatusOK)
+		assert.Equal(t, []string{"00000000-0000-4000-8000-000000000001"}, deviceIDs(data))
+	})
+
+	t.Run("Never exposes private keys", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		server.Mux.ServeHTTP(rr, httptest.NewRequest("GET", "/api/v0/devices", nil))
+		assert.NotContains(t, rr.Body.String(), "private")
+	})
+
+	t.Run("Rejects invalid parameters", func(t *testing.T) {
+		getData(t, server, "/api/v0/devices?limit=0", http.StatusBadRequest)
+		getData(t, server, "/api/v0/devices?cursor=!!!", http.StatusBadRequest)
+		getData(t, server, "/api/v0/devices?algorithm=DSA", http.StatusBadRequest)
+	})
+}
+
+func patchDevice(t *testing.T, server *api.Server, id, body string, expectedStatus int) map[string]interface{} {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/api/v0/devices/"+id, bytes.NewBufferString(body)))
+	require.Equal(t, expectedStatus, rr.Code, rr.Body.String())
+	if expectedStatus != http.StatusOK {
+		return nil
+	}
+
+	var resp api.Response
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	return resp.Data.(map[string]interface{})
+}
+
+func TestUpdateSignatureDevice(t *testing.T) {
+	forEachStore(t, testUpdateSignatureDevice)
+}
+
+func testUpdateSignatureDevice(t *testing.T, store persistence.DeviceStore) {
+	server := newServer(store)
+	createDevice(t, server, "00000000-0000-4000-8000-000000000001", domain.AlgorithmECC, "Till 1")
+	createDevice(t, server, "00000000-0000-4000-8000-000000000002", domain.AlgorithmECC, "Till 2")
+	assert.Equal(t, domain.StatusActive, getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-000000000001", http.StatusOK)["status"])
+
+	signStatus := func(id string) int {
+		rr := httptest.NewRecorder()
+		server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices/"+id+"/sign", bytes.NewBufferString(`{"data_to_be_signed": "data"}`)))
+		return rr.Code
+	}
+	jwksKeyIDs := func() []string {
+		rr := httptest.NewRecorder()
+		server.Mux.ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+		var set struct {
+			Keys []struct {
+				KeyID string `json:"kid"`
+			} `json:"keys"`
+		}
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&set))
+		var ids []string
+		for _, key := range set.Keys {
+			ids = append(ids, key.KeyID)
+		}
+		return ids
+	}
+
+	data := patchDevice(t, server, "00000000-0000-4000-8000-000000000001", `{"label": "Till 1a"}`, http.StatusOK)
+	assert.Equal(t, "Till 1a", data["label"])
+	assert.Equal(t, domain.StatusActive, data["status"])
+
+	data = patchDevice(t, server, "00000000-0000-4000-8000-000000000001", `{"status": "SUSPENDED"}`, http.StatusOK)
+	assert.Equal(t, domain.StatusSuspended, data["status"])
+	assert.Equal(t, "Till 1a", data["label"], "label must not change")
+	assert.Equal(t, http.StatusConflict, signStatus("00000000-0000-4000-8000-000000000001"))
+	assert.Equal(t, []string{"00000000-0000-4000-8000-000000000002#1"}, jwksKeyIDs(), "only active devices are published")
+
+	patchDevice(t, server, "00000000-0000-4000-8000-000000000001", `{"status": "ACTIVE"}`, http.StatusOK)
+	assert.Equal(t, http.StatusOK, signStatus("00000000-0000-4000-8000-000000000001"))
+
+	data = patchDevice(t, server, "00000000-0000-4000-8000-000000000001", `{"status": "DECOMMISSIONED"}`, http.StatusOK)
+	assert.Equal(t, domain.StatusDecommissioned, data["status"])
+	assert.NotEmpty(t, data["public_key"], "public key is kept")
+	assert.Equal(t, http.StatusConflict, signStatus("00000000-0000-4000-8000-000000000001"))
+	getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-000000000001/signatures/0", http.StatusOK)
+
+	patchDevice(t, server, "00000000-0000-4000-8000-000000000001", `{"status": "ACTIVE"}`, http.StatusConflict)
+	patchDevice(t, server, "00000000-0000-4000-8000-000000000001", `{"status": "DELETED"}`, http.StatusBadRequest)
+	patchDevice(t, server, "unknown", `{"label": "x"}`, http.StatusNotFound)
+}
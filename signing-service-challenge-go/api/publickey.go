@@ -0,0 +1,156 @@
+package api
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
+)
+
+const (
+	contentTypePEM    = "application/x-pem-file"
+	contentTypeDER    = "application/octet-stream"
+	contentTypeJWK    = "application/jwk+json"
+	contentTypeJSON   = "application/json"
+	contentTypeJWKSet = "application/jwk-set+json"
+)
+
+// publicKeyContentTypes are the formats a public key can be exported in, in order of preference.
+var publicKeyContentTypes = []string{contentTypePEM, contentTypeDER, contentTypeJWK, contentTypeJSON}
+
+// GetPublicKey exports the public key of a device as PEM (the default), DER or JWK,
+// depending on the Accept header. The key ID of the JWK is the device ID and the key version,
+// like <device ID>#2.
+func (s *Server) GetPublicKey(w http.ResponseWriter, r *http.Request) {
+	contentType := negotiateContentType(r.Header.Get("Accept"), publicKeyContentTypes)
+	if contentType == "" {
+		WriteErrorResponse(w, http.StatusNotAcceptable,
+			[]string{"public keys are available as " + strings.Join(publicKeyContentTypes, ", ")})
+		return
+	}
+
+	publicKey, err := s.devices.GetPublicKey(r.PathValue("id"))
+	if err != nil {
+		writeServiceError(w, err, "Failed to get public key")
+		return
+	}
+
+	var body []byte
+	switch contentType {
+	case contentTypePEM:
+		body, err = crypt.PEMMarshaler{}.EncodePublicKey(publicKey.Key)
+	case contentTypeDER:
+		body, err = crypt.DERMarshaler{}.EncodePublicKey(publicKey.Key)
+	default:
+		var jwk crypt.JWK
+		jwk, err = newJWK(publicKey)
+		if err == nil {
+			body, err = json.MarshalIndent(jwk, "", "  ")
+		}
+	}
+	if err != nil {
+		writeServiceError(w, err, "Failed to encode public key")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// ListPublicKeys publishes the public keys of all active devices as a JWK set, so clients
+// can verify signatures offline with standard JOSE libraries. Every key version of a device is
+// included, the version that signed a signature is its key_version.
+func (s *Server) ListPublicKeys(w http.ResponseWriter, r *http.Request) {
+	publicKeys, err := s.devices.ListPublicKeys()
+	if err != nil {
+		writeServiceError(w, err, "Failed to list public keys")
+		return
+	}
+
+	set := crypt.JWKSet{Keys: make([]crypt.JWK, 0, len(publicKeys))}
+	for _, publicKey := range publicKeys {
+		jwk, err := newJWK(publicKey)
+		if err != nil {
+			writeServiceError(w, err, "Failed to list public keys")
+			return
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	body, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		WriteInternalError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJWKSet)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func newJWK(publicKey service.PublicKey) (crypt.JWK, error) {
+	return crypt.NewJWK(publicKey.Key, publicKey.KeyID(), publicKey.Scheme)
+}
+
+// negotiateContentType picks the offer the Accept header prefers, following RFC 9110, section 12.5.1.
+// Offers are in order of preference for equal quality. A missing header accepts the first offer,
+// an empty result means that none is acceptable.
+func negotiateContentType(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQuality := "", 0.0
+	for _, offer := range offers {
+		quality := acceptQuality(accept, offer)
+		if quality > bestQuality {
+			best, bestQuality = offer, quality
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality the Accept header gives contentType,
+// taken from the most specific matching media range.
+func acceptQuality(accept string, contentType string) float64 {
+	offerType, _, _ := strings.Cut(contentType, "/")
+
+	quality, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		var match int
+		switch {
+		case mediaType == contentType:
+			match = 2
+		case mediaType == offerType+"/*":
+			match = 1
+		case mediaType == "*/*":
+			match = 0
+		default:
+			continue
+		}
+		if match < specificity {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = q, match
+	}
+
+	return quality
+}
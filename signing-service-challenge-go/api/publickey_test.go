@@ -0,0 +1,128 @@
+package api_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/api"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+func getPublicKey(t *testing.T, server *api.Server, deviceID, accept string, expectedStatus int) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/v0/devices/"+deviceID+"/public-key", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, req)
+	require.Equal(t, expectedStatus, rr.Code, rr.Body.String())
+	return rr
+}
+
+func TestGetPublicKey(t *testing.T) {
+	forEachStore(t, testGetPublicKey)
+}
+
+func testGetPublicKey(t *testing.T, store persistence.DeviceStore) {
+	server := newServer(store)
+	createDevice(t, server, "00000000-0000-4000-8000-000000000001", domain.AlgorithmECC, "Till 1")
+
+	t.Run("PEM by default", func(t *testing.T) {
+		rr := getPublicKey(t, server, "00000000-0000-4000-8000-000000000001", "", http.StatusOK)
+		assert.Equal(t, "application/x-pem-file", rr.Header().Get("Content-Type"))
+
+		block, _ := pem.Decode(rr.Body.Bytes())
+		require.NotNil(t, block)
+		assert.Equal(t, "PUBLIC KEY", block.Type)
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		require.NoError(t, err)
+		assert.IsType(t, &ecdsa.PublicKey{}, publicKey)
+	})
+
+	t.Run("DER", func(t *testing.T) {
+		rr := getPublicKey(t, server, "00000000-0000-4000-8000-000000000001", "application/octet-stream", http.StatusOK)
+		assert.Equal(t, "application/octet-stream", rr.Header().Get("Content-Type"))
+
+		_, err := x509.ParsePKIXPublicKey(rr.Body.Bytes())
+		assert.NoError(t, err)
+	})
+
+	t.Run("JWK", func(t *testing.T) {
+		rr := getPublicKey(t, server, "00000000-0000-4000-8000-000000000001", "text/html;q=0.9, application/jwk+json", http.StatusOK)
+		assert.Equal(t, "application/jwk+json", rr.Header().Get("Content-Type"))
+
+		var jwk crypt.JWK
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&jwk))
+		assert.Equal(t, "00000000-0000-4000-8000-000000000001#1", jwk.KeyID)
+		assert.Equal(t, "EC", jwk.KeyType)
+		assert.Equal(t, "P-384", jwk.Curve)
+		assert.Empty(t, jwk.Algorithm, "ECDSA_P384_SHA256 has no JWS algorithm")
+		assert.NotEmpty(t, jwk.X)
+		assert.NotEmpty(t, jwk.Y)
+	})
+
+	t.Run("Quality values", func(t *testing.T) {
+		rr := getPublicKey(t, server, "00000000-0000-4000-8000-000000000001", "application/*;q=0.5, application/json", http.StatusOK)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	})
+
+	t.Run("Not acceptable", func(t *testing.T) {
+		getPublicKey(t, server, "00000000-0000-4000-8000-000000000001", "text/html", http.StatusNotAcceptable)
+		getPublicKey(t, server, "00000000-0000-4000-8000-000000000001", "*/*;q=0", http.StatusNotAcceptable)
+	})
+
+	t.Run("Unknown device", func(t *testing.T) {
+		getPublicKey(t, server, "unknown", "", http.StatusNotFound)
+	})
+}
+
+func TestListPublicKeys(t *testing.T) {
+	store := persistence.NewInMemoryDeviceStore()
+	server := newServer(store)
+	createDevice(t, server, "00000000-0000-4000-8000-000000000001", domain.AlgorithmRSA, "Till 1")
+	createDevice(t, server, "00000000-0000-4000-8000-000000000002", domain.AlgorithmEd25519, "Till 2")
+	// A key that cannot be decoded is left out instead of failing the whole set.
+	require.NoError(t, store.Create(domain.SignatureDevice{ID: "00000000-0000-4000-8000-000000000003", Algorithm: domain.AlgorithmECC, PublicKey: []byte("broken")}))
+
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	assert.Equal(t, "application/jwk-set+json", rr.Header().Get("Content-Type"))
+
+	var set crypt.JWKSet
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&set))
+	require.Len(t, set.Keys, 2)
+	assert.Equal(t, "00000000-0000-4000-8000-000000000001#1", set.Keys[0].KeyID)
+	assert.Equal(t, "RSA", set.Keys[0].KeyType)
+	assert.Equal(t, "RS256", set.Keys[0].Algorithm)
+	assert.Equal(t, "00000000-0000-4000-8000-000000000002#1", set.Keys[1].KeyID)
+	assert.Equal(t, "OKP", set.Keys[1].KeyType)
+	assert.Equal(t, "EdDSA", set.Keys[1].Algorithm)
+
+	// The previous key stays published after a rotation, for the signatures it created.
+	rr = httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices/00000000-0000-4000-8000-000000000002/rotate-key", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	set = crypt.JWKSet{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&set))
+	require.Len(t, set.Keys, 3)
+	assert.Equal(t, "00000000-0000-4000-8000-000000000002#1", set.Keys[1].KeyID)
+	assert.Equal(t, "00000000-0000-4000-8000-000000000002#2", set.Keys[2].KeyID)
+	assert.NotEqual(t, set.Keys[1].X, set.Keys[2].X)
+
+	jwk := getPublicKey(t, server, "00000000-0000-4000-8000-000000000002", "application/jwk+json", http.StatusOK)
+	assert.Contains(t, jwk.Body.String(), `"kid": "00000000-0000-4000-8000-000000000002#2"`)
+}
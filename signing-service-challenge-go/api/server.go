@@ -2,9 +2,20 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 
-	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
+)
+
+const (
+	// MaxRequestBodySize limits the size of request bodies, so a client cannot exhaust memory.
+	MaxRequestBodySize = 1 << 20
+	// MaxBatchItemSize is the room a batch signing request has per transaction: its body may be
+	// the service's MaxBatchSize times this, but at least MaxRequestBodySize. A full batch can
+	// hold transactions of this size on average, a batch of a single one up to MaxRequestBodySize.
+	MaxBatchItemSize = 16 << 10
 )
 
 // Response is the generic API response container.
@@ -19,25 +30,38 @@ type ErrorResponse struct {
 
 // Server manages HTTP requests and dispatches them to the appropriate services.
 type Server struct {
-	listenAddress string
-	store         persistence.DeviceStore
-	Mux           *http.ServeMux // Makes mux available for testing
+	listenAddress    string
+	devices          *service.DeviceService
+	maxBatchBodySize int64
+	Mux              *http.ServeMux // Makes mux available for testing
 }
 
-func NewServer(listenAddress string, store persistence.DeviceStore) *Server {
+func NewServer(listenAddress string, devices *service.DeviceService) *Server {
 	mux := http.NewServeMux()
 	server := &Server{
-		listenAddress: listenAddress,
-		store:         store,
-		Mux:           mux,
+		listenAddress:    listenAddress,
+		devices:          devices,
+		maxBatchBodySize: max(MaxRequestBodySize, int64(devices.MaxBatchSize())*MaxBatchItemSize),
+		Mux:              mux,
 	}
 
 	mux.HandleFunc("GET /api/v0/health", server.Health)
 	mux.HandleFunc("POST /api/v0/devices", server.CreateSignatureDevice)
+	mux.HandleFunc("GET /api/v0/devices", server.ListSignatureDevices)
+	mux.HandleFunc("GET /api/v0/devices/{id}", server.GetSignatureDevice)
+	mux.HandleFunc("PATCH /api/v0/devices/{id}", server.UpdateSignatureDevice)
+	mux.HandleFunc("GET /api/v0/devices/{id}/public-key", server.GetPublicKey)
+	mux.HandleFunc("GET /api/v0/devices/{id}/certificate", server.GetCertificate)
+	mux.HandleFunc("POST /api/v0/devices/{id}/certificate", server.IssueCertificate)
+	mux.HandleFunc("PUT /api/v0/devices/{id}/certificate", server.UploadCertificate)
+	mux.HandleFunc("POST /api/v0/devices/{id}/certificate/csr", server.CreateCertificateSigningRequest)
+	mux.HandleFunc("POST /api/v0/devices/{id}/rotate-key", server.RotateKey)
 	mux.HandleFunc("POST /api/v0/devices/{id}/sign", server.SignData)
-	// TODO: List / retrieval operations for devices:
-	// GET /api/v0/devices/
-	// GET /api/v0/devices/{id}
+	mux.HandleFunc("POST /api/v0/devices/{id}/sign/batch", server.SignBatch)
+	mux.HandleFunc("POST /api/v0/devices/{id}/verify", server.VerifySignature)
+	mux.HandleFunc("GET /api/v0/devices/{id}/signatures", server.ListSignatures)
+	mux.HandleFunc("GET /api/v0/devices/{id}/signatures/{counter}", server.GetSignature)
+	mux.HandleFunc("GET /.well-known/jwks.json", server.ListPublicKeys)
 
 	return server
 }
@@ -46,6 +70,60 @@ func (s *Server) Run() error {
 	return http.ListenAndServe(s.listenAddress, s.Mux)
 }
 
+// decodeRequest reads the JSON request body into v. It writes an error response
+// and returns false if the body is too large or cannot be decoded.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	return decodeLimitedRequest(w, r, v, MaxRequestBodySize)
+}
+
+// decodeLimitedRequest is decodeRequest for bodies of up to maxSize bytes.
+func decodeLimitedRequest(w http.ResponseWriter, r *http.Request, v interface{}, maxSize int64) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			WriteErrorResponse(w, http.StatusRequestEntityTooLarge, []string{"request body is too large"})
+			return false
+		}
+		WriteErrorResponse(w, http.StatusBadRequest, []string{"invalid request body: " + err.Error()})
+		return false
+	}
+
+	return true
+}
+
+// writeServiceError maps the errors of the service layer to HTTP status codes.
+// Unexpected errors are logged and answered with the generic fallback message.
+func writeServiceError(w http.ResponseWriter, err error, fallback string) {
+	var transactionErr *service.TransactionError
+	switch {
+	case errors.As(err, &transactionErr):
+		fields := make([]string, 0, len(transactionErr.Fields))
+		for _, field := range transactionErr.Fields {
+			fields = append(fields, field.String())
+		}
+		WriteErrorResponse(w, http.StatusUnprocessableEntity, fields)
+	case errors.Is(err, service.ErrInvalidInput):
+		WriteErrorResponse(w, http.StatusBadRequest, []string{err.Error()})
+	case errors.Is(err, service.ErrUnsupportedAlgorithm):
+		WriteErrorResponse(w, http.StatusBadRequest, []string{"Unsupported algorithm"})
+	case errors.Is(err, service.ErrDeviceNotFound), errors.Is(err, service.ErrSignatureNotFound),
+		errors.Is(err, service.ErrCertificateNotFound):
+		WriteErrorResponse(w, http.StatusNotFound, []string{err.Error()})
+	case errors.Is(err, service.ErrDeviceNotActive), errors.Is(err, service.ErrInvalidTransition),
+		errors.Is(err, service.ErrIdempotencyKeyReused), errors.Is(err, service.ErrDeviceExists),
+		errors.Is(err, service.ErrConcurrentRotation):
+		WriteErrorResponse(w, http.StatusConflict, []string{err.Error()})
+	case errors.Is(err, service.ErrSigningFailed):
+		WriteErrorResponse(w, http.StatusInternalServerError, []string{err.Error()})
+	default:
+		log.Default().Printf("unexpected error: %v", err)
+		WriteErrorResponse(w, http.StatusInternalServerError, []string{fallback})
+	}
+}
+
 // WriteInternalError writes a default internal error message as an HTTP response.
 func WriteInternalError(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
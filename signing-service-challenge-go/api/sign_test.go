@@ -6,21 +6,73 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/api"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
 	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/keys"
 	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
 )
 
-func setupTestServer() (*api.Server, *persistence.InMemoryDeviceStore) {
-	store := persistence.NewInMemoryDeviceStore()
-	server := api.NewServer(":8080", store)
+// testStores creates a fresh instance of every DeviceStore implementation the API tests run against.
+var testStores = []struct {
+	name     string
+	newStore func(t *testing.T) persistence.DeviceStore
+}{
+	{
+		name: "memory",
+		newStore: func(t *testing.T) persistence.DeviceStore {
+			return persistence.NewInMemoryDeviceStore()
+		},
+	},
+	{
+		name: "file",
+		newStore: func(t *testing.T) persistence.DeviceStore {
+			store, err := persistence.NewFileDeviceStore(t.TempDir(), 0)
+			require.NoError(t, err)
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+	},
+	{
+		name: "sqlite",
+		newStore: func(t *testing.T) persistence.DeviceStore {
+			store, err := persistence.NewSQLiteDeviceStore(filepath.Join(t.TempDir(), "devices.db"))
+			require.NoError(t, err)
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+	},
+}
+
+// forEachStore runs a test once for every DeviceStore implementation.
+func forEachStore(t *testing.T, test func(t *testing.T, store persistence.DeviceStore)) {
+	for _, ts := range testStores {
+		t.Run(ts.name, func(t *testing.T) {
+			test(t, ts.newStore(t))
+		})
+	}
+}
+
+// newServer creates a server with an in-memory key token, which encrypts keys like in production.
+func newServer(store persistence.DeviceStore) *api.Server {
+	wrapper, _ := crypt.NewKeyWrapper(make([]byte, crypt.KEKSize))
+	token, _ := keys.NewSoftToken("", wrapper) // cannot fail without a file
+	return api.NewServer(":8080", service.NewDeviceService(store, token, service.DefaultConfig()))
+}
+
+func setupTestServer(store persistence.DeviceStore) *api.Server {
+	server := newServer(store)
 
 	createReq := map[string]string{
-		"id":        "test-device",
+		"id":        "00000000-0000-4000-8000-00000000000a",
 		"algorithm": domain.AlgorithmECC,
 		"label":     "Test Device",
 	}
@@ -44,11 +96,15 @@ func setupTestServer() (*api.Server, *persistence.InMemoryDeviceStore) {
 		panic(fmt.Sprintf("failed to create test device: status %d, body %s", rr.Code, rr.Body.String()))
 	}
 
-	return server, store
+	return server
 }
 
 func TestSignData(t *testing.T) {
-	server, store := setupTestServer()
+	forEachStore(t, testSignData)
+}
+
+func testSignData(t *testing.T, store persistence.DeviceStore) {
+	server := setupTestServer(store)
 
 	tests := []struct {
 		name           string
@@ -59,17 +115,52 @@ func TestSignData(t *testing.T) {
 	}{
 		{
 			name:           "First signature",
-			deviceID:       "test-device",
+			deviceID:       "00000000-0000-4000-8000-00000000000a",
 			requestBody:    `{"data_to_be_signed": "first test"}`,
 			expectedStatus: http.StatusOK,
 			validate: func(t *testing.T, resp *api.SignResponse) {
 				assert.Contains(t, resp.SignedData, "0_first test")
-				updatedDevice, err := store.Get("test-device")
+				updatedDevice, err := store.Get("00000000-0000-4000-8000-00000000000a")
 				require.NoError(t, err)
 				assert.Equal(t, uint64(1), updatedDevice.SignatureCounter)
 				assert.NotEmpty(t, updatedDevice.LastSignature)
 			},
 		},
+		{
+			name:           "Second signature chains to the first",
+			deviceID:       "00000000-0000-4000-8000-00000000000a",
+			requestBody:    `{"data_to_be_signed": "second test"}`,
+			expectedStatus: http.StatusOK,
+			validate: func(t *testing.T, resp *api.SignResponse) {
+				first, err := store.GetSignature("00000000-0000-4000-8000-00000000000a", 0)
+				require.NoError(t, err)
+				assert.Equal(t, "1_second test_"+first.Signature, resp.SignedData)
+			},
+		},
+		{
+			name:           "Missing data",
+			deviceID:       "00000000-0000-4000-8000-00000000000a",
+			requestBody:    `{}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Undecodable body",
+			deviceID:       "00000000-0000-4000-8000-00000000000a",
+			requestBody:    `{"data_to_be_signed": `,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Body too large",
+			deviceID:       "00000000-0000-4000-8000-00000000000a",
+			requestBody:    `{"data_to_be_signed": "` + strings.Repeat("x", api.MaxRequestBodySize) + `"}`,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "Unknown device",
+			deviceID:       "unknown-device",
+			requestBody:    `{"data_to_be_signed": "test"}`,
+			expectedStatus: http.StatusNotFound,
+		},
 		// Here be further tests for various api edge cases
 	}
 
@@ -101,8 +192,163 @@ func TestSignData(t *testing.T) {
 					tt.validate(t, &signResp)
 				}
 			} else {
-				// Test user error handling
+				var resp api.ErrorResponse
+				err := json.NewDecoder(rr.Body).Decode(&resp)
+				assert.NoError(t, err, "failed to decode error response")
+				assert.NotEmpty(t, resp.Errors)
+
+				// A failed request must not advance the counter.
+				device, err := store.Get("00000000-0000-4000-8000-00000000000a")
+				require.NoError(t, err)
+				assert.Equal(t, uint64(2), device.SignatureCounter)
+			}
+		})
+	}
+}
+
+func TestSignDataIdempotency(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store persistence.DeviceStore) {
+		server := setupTestServer(store)
+
+		sign := func(key string, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/api/v0/devices/00000000-0000-4000-8000-00000000000a/sign", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", key)
+			rr := httptest.NewRecorder()
+			server.Mux.ServeHTTP(rr, req)
+			return rr
+		}
+
+		first := sign("receipt-42", `{"data_to_be_signed": "receipt 42"}`)
+		require.Equal(t, http.StatusOK, first.Code)
+
+		retry := sign("receipt-42", `{"data_to_be_signed": "receipt 42"}`)
+		assert.Equal(t, http.StatusOK, retry.Code)
+		assert.JSONEq(t, first.Body.String(), retry.Body.String())
+
+		conflict := sign("receipt-42", `{"data_to_be_signed": "receipt 43"}`)
+		assert.Equal(t, http.StatusConflict, conflict.Code)
+
+		next := sign("receipt-43", `{"data_to_be_signed": "receipt 43"}`)
+		assert.Equal(t, http.StatusOK, next.Code)
+
+		device, err := store.Get("00000000-0000-4000-8000-00000000000a")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), device.SignatureCounter)
+	})
+}
+
+func TestSignBatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store persistence.DeviceStore) {
+		server := setupTestServer(store)
+
+		signBatch := func(body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/api/v0/devices/00000000-0000-4000-8000-00000000000a/sign/batch", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			server.Mux.ServeHTTP(rr, req)
+			return rr
+		}
+
+		rr := signBatch(`{"items": [{"data_to_be_signed": "first"}, {"data_to_be_signed": "second"}]}`)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var resp struct {
+			Data struct {
+				Signatures []api.SignResponse `json:"signatures"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		signatures := resp.Data.Signatures
+		require.Len(t, signatures, 2)
+		assert.True(t, strings.HasPrefix(signatures[0].SignedData, "0_first_"))
+		assert.Equal(t, "1_second_"+signatures[0].Signature, signatures[1].SignedData)
+
+		assert.Equal(t, http.StatusBadRequest, signBatch(`{"items": []}`).Code)
+		assert.Equal(t, http.StatusBadRequest, signBatch(`{"items": [{"data_to_be_signed": "third"}, {}]}`).Code)
+		tooMany := `{"items": [` + strings.Repeat(`{"data_to_be_signed": "x"}, `, service.DefaultMaxBatchSize) + `{"data_to_be_signed": "x"}]}`
+		assert.Equal(t, http.StatusBadRequest, signBatch(tooMany).Code)
+
+		device, err := store.Get("00000000-0000-4000-8000-00000000000a")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), device.SignatureCounter, "failed batches sign nothing")
+
+		// Batches may be larger than other requests, in proportion to the number of transactions.
+		item := `{"data_to_be_signed": "` + strings.Repeat("x", api.MaxBatchItemSize/2) + `"}`
+		large := `{"items": [` + strings.Repeat(item+", ", 2*api.MaxRequestBodySize/api.MaxBatchItemSize) + item + `]}`
+		require.Greater(t, len(large), api.MaxRequestBodySize)
+		assert.Equal(t, http.StatusOK, signBatch(large).Code)
+		tooLarge := `{"items": [{"data_to_be_signed": "` + strings.Repeat("x", service.DefaultMaxBatchSize*api.MaxBatchItemSize) + `"}]}`
+		assert.Equal(t, http.StatusRequestEntityTooLarge, signBatch(tooLarge).Code)
+	})
+}
+
+func TestSignDataWithTransactionSchema(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store persistence.DeviceStore) {
+		server := newServer(store)
+		id := "00000000-0000-4000-8000-000000000001"
+
+		rr := httptest.NewRecorder()
+		server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices",
+			strings.NewReader(`{"id": "`+id+`", "algorithm": "ECC", "transaction_schema": "RECEIPT"}`)))
+		require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+		sign := func(transaction string) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(map[string]string{"data_to_be_signed": transaction})
+			rr := httptest.NewRecorder()
+			server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices/"+id+"/sign", bytes.NewReader(body)))
+			return rr
+		}
+
+		rr = sign(`{"currency": "EUR", "amount": 5, "timestamp": "2024-05-01T12:00:00Z", "vat_lines": [{"rate": 7, "net": 4.67, "vat": 0.33}]}`)
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		assert.Contains(t, rr.Body.String(), `0_{\"amount\":5,\"currency\":\"EUR\"`)
+
+		rr = sign(`{"currency": "EUR", "amount": 5, "timestamp": "now", "vat_lines": [{"rate": -7, "net": 4.67, "vat": 0.33}]}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+		var resp api.ErrorResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+		assert.Equal(t, []string{"timestamp: must be an RFC 3339 date-time", "vat_lines[0].rate: must be at least 0"}, resp.Errors)
+
+		device := getData(t, server, "/api/v0/devices/"+id, http.StatusOK)
+		assert.Equal(t, "RECEIPT", device["transaction_schema"])
+		assert.Equal(t, float64(1), device["signature_counter"])
+	})
+}
+
+// BenchmarkSignData compares concurrent signing on a single device, which is serialized,
+// with concurrent signing on many devices, which runs in parallel.
+func BenchmarkSignData(b *testing.B) {
+	const devices = 16
+
+	for _, bb := range []struct {
+		name    string
+		devices int
+	}{
+		{name: "SameDevice", devices: 1},
+		{name: "DifferentDevices", devices: devices},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			server := newServer(persistence.NewInMemoryDeviceStore())
+			for i := 0; i < bb.devices; i++ {
+				reqBody := fmt.Sprintf(`{"id": "00000000-0000-4000-8000-%012d", "algorithm": "%s"}`, i, domain.AlgorithmECC)
+				rr := httptest.NewRecorder()
+				server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices", bytes.NewBufferString(reqBody)))
+				require.Equal(b, http.StatusCreated, rr.Code)
 			}
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				deviceID := fmt.Sprintf("00000000-0000-4000-8000-%012d", next.Add(1)%int64(bb.devices))
+				for pb.Next() {
+					rr := httptest.NewRecorder()
+					req := httptest.NewRequest("POST", "/api/v0/devices/"+deviceID+"/sign", bytes.NewBufferString(`{"data_to_be_signed": "benchmark"}`))
+					server.Mux.ServeHTTP(rr, req)
+					if rr.Code != http.StatusOK {
+						b.Fatalf("signing failed: status %d, body %s", rr.Code, rr.Body.String())
+					}
+				}
+			})
 		})
 	}
 }
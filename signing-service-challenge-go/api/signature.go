@@ -1,27 +1,72 @@
 package api
 
 import (
-	"encoding/base64"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 
-	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
 	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
-	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
 )
 
+// signRequest is a transaction to sign, either data_to_be_signed or a digest of it.
 type signRequest struct {
-	DataToBeSigned string `json:"data_to_be_signed"`
+	DataToBeSigned    string `json:"data_to_be_signed,omitempty"`
+	Encoding          string `json:"encoding,omitempty"`            // of data_to_be_signed, "text" (default) or "base64" for binary data
+	Digest            string `json:"digest,omitempty"`              // base64 encoded hash of the transaction, computed by the client
+	DigestAlgorithm   string `json:"digest_algorithm,omitempty"`    // SHA256, SHA384 or SHA512
+	SecuredDataFormat int    `json:"secured_data_format,omitempty"` // 1 (default for text) or 2 (default otherwise)
 }
 
 type SignResponse struct {
-	Signature  string `json:"signature"`
-	SignedData string `json:"signed_data"`
+	Signature         string `json:"signature"`
+	Scheme            string `json:"scheme"`
+	KeyVersion        int    `json:"key_version"`
+	SecuredDataFormat int    `json:"secured_data_format"`
+	SignedData        string `json:"signed_data"` // base64 encoded if secured_data_format is 2
 }
 
+// signBatchRequest lists the transactions to sign, in order.
+type signBatchRequest struct {
+	Items []signRequest `json:"items"`
+}
+
+type signBatchResponse struct {
+	Signatures []SignResponse `json:"signatures"` // in the order of the items
+}
+
+type signatureResponse struct {
+	Counter           uint64    `json:"counter"`
+	Signature         string    `json:"signature"`
+	Scheme            string    `json:"scheme,omitempty"`      // unknown for signatures created before it was recorded
+	KeyVersion        int       `json:"key_version,omitempty"` // unknown for signatures created before keys could be rotated
+	SecuredDataFormat int       `json:"secured_data_format"`
+	SignedData        string    `json:"signed_data"` // base64 encoded if secured_data_format is 2
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+type listSignaturesResponse struct {
+	Signatures []signatureResponse `json:"signatures"`
+	NextCursor string              `json:"next_cursor,omitempty"` // opaque, pass as "cursor" to get the next page
+}
+
+func newSignatureResponse(signature domain.Signature) signatureResponse {
+	return signatureResponse{
+		Counter:           signature.Counter,
+		Signature:         signature.Signature,
+		Scheme:            signature.Scheme,
+		KeyVersion:        signature.KeyVersion,
+		SecuredDataFormat: service.SecuredDataFormat(signature),
+		SignedData:        signature.SignedData,
+		CreatedAt:         signature.CreatedAt,
+	}
+}
+
+// SignData signs data_to_be_signed, or the digest of it, with the device's key, chained to the
+// previous signature.
+// The request is read and validated before the device is locked, so a slow client cannot
+// hold up other requests to the same device.
+// A retry with the same Idempotency-Key header gets the response of the first request.
 func (s *Server) SignData(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
@@ -29,86 +74,116 @@ func (s *Server) SignData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var signedData string
-	var signature []byte
-	var (
-		ErrRequest  = errors.New("invalid request")
-		ErrInternal = errors.New("internal error")
-	)
-	operation := func(device *domain.SignatureDevice) error {
-		var req signRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			return fmt.Errorf("invalid request body: %w", err)
-		}
-		defer r.Body.Close()
-
-		if req.DataToBeSigned == "" {
-			return fmt.Errorf("%w: data_to_be_signed is required", ErrRequest)
-		}
-
-		counter := device.SignatureCounter
-		lastSignature := getLastSignature(*device)
-		signedData = fmt.Sprintf("%d_%s_%s", counter, req.DataToBeSigned, lastSignature)
-
-		var err error
-		signature, err = signData(signedData, device.Algorithm, device.PrivateKey)
-		if err != nil {
-			return fmt.Errorf("%w: signing failed: %v", ErrInternal, err)
-		}
-
-		device.LastSignature = base64.StdEncoding.EncodeToString(signature)
-		device.SignatureCounter += 1
-		return nil
-	}
-
-	if err := s.store.InTx(id, operation); err != nil {
-		var status int
-		var msg string
-		switch {
-		case errors.Is(err, persistence.ErrDeviceNotFound):
-			status, msg = http.StatusNotFound, err.Error()
-		case errors.Is(err, ErrRequest):
-			status, msg = http.StatusBadRequest, err.Error()
-		case errors.Is(err, ErrInternal):
-			status, msg = http.StatusInternalServerError, err.Error()
-		default:
-			status, msg = http.StatusInternalServerError, "Operation failed"
-			log.Default().Printf("unexpected error: %v", err)
-		}
-		WriteErrorResponse(w, status, []string{msg})
+	var req signRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	params := req.params()
+	params.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	signature, err := s.devices.Sign(id, params)
+	if err != nil {
+		writeServiceError(w, err, "Operation failed")
+		return
+	}
+
+	WriteAPIResponse(w, http.StatusOK, newSignResponse(signature))
+}
+
+// SignBatch signs the items in order under one lock of the device, so their counters are
+// consecutive. If one of them cannot be signed, none is.
+func (s *Server) SignBatch(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		WriteErrorResponse(w, http.StatusBadRequest, []string{"device ID is required"})
+		return
+	}
+
+	var req signBatchRequest
+	if !decodeLimitedRequest(w, r, &req, s.maxBatchBodySize) {
 		return
 	}
 
-	response := SignResponse{
-		Signature:  base64.StdEncoding.EncodeToString(signature),
-		SignedData: signedData,
+	batch := make([]service.SignParams, 0, len(req.Items))
+	for _, item := range req.Items {
+		batch = append(batch, item.params())
+	}
+	signatures, err := s.devices.SignBatch(id, batch)
+	if err != nil {
+		writeServiceError(w, err, "Operation failed")
+		return
+	}
+
+	response := signBatchResponse{Signatures: make([]SignResponse, 0, len(signatures))}
+	for _, signature := range signatures {
+		response.Signatures = append(response.Signatures, newSignResponse(signature))
 	}
 	WriteAPIResponse(w, http.StatusOK, response)
 }
 
-func getLastSignature(device domain.SignatureDevice) string {
-	if device.LastSignature == "" {
-		return base64.StdEncoding.EncodeToString([]byte(device.ID))
+func newSignResponse(signature domain.Signature) SignResponse {
+	return SignResponse{
+		Signature:         signature.Signature,
+		Scheme:            signature.Scheme,
+		KeyVersion:        signature.KeyVersion,
+		SecuredDataFormat: service.SecuredDataFormat(signature),
+		SignedData:        signature.SignedData,
 	}
+}
 
-	return device.LastSignature
+func (req signRequest) params() service.SignParams {
+	return service.SignParams{
+		DataToBeSigned:    req.DataToBeSigned,
+		Encoding:          req.Encoding,
+		Digest:            req.Digest,
+		DigestAlgorithm:   req.DigestAlgorithm,
+		SecuredDataFormat: req.SecuredDataFormat,
+	}
 }
 
-func signData(data string, algorithm string, privateKey []byte) ([]byte, error) {
-	var signer crypt.Signer
-	var err error
+// ListSignatures pages through the signature history of a device, ordered by counter.
+// Supported query parameters are limit and cursor.
+func (s *Server) ListSignatures(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
 
-	switch algorithm {
-	case domain.AlgorithmECC:
-		signer, err = crypt.NewECCKeySigner(privateKey)
-	case domain.AlgorithmRSA:
-		signer, err = crypt.NewRSAKeySigner(privateKey)
-	default:
-		return nil, errors.New("unsupported algorithm")
+	limit, ok := parseLimit(w, query.Get("limit"))
+	if !ok {
+		return
 	}
+
+	page, err := s.devices.ListSignatures(r.PathValue("id"), service.ListSignaturesParams{
+		Cursor: query.Get("cursor"),
+		Limit:  limit,
+	})
 	if err != nil {
-		return nil, err
+		writeServiceError(w, err, "Failed to list signatures")
+		return
+	}
+
+	response := listSignaturesResponse{
+		Signatures: make([]signatureResponse, 0, len(page.Signatures)),
+		NextCursor: page.NextCursor,
+	}
+	for _, signature := range page.Signatures {
+		response.Signatures = append(response.Signatures, newSignatureResponse(signature))
+	}
+
+	WriteAPIResponse(w, http.StatusOK, response)
+}
+
+// GetSignature returns the signature a device created at the given counter.
+func (s *Server) GetSignature(w http.ResponseWriter, r *http.Request) {
+	counter, err := strconv.ParseUint(r.PathValue("counter"), 10, 64)
+	if err != nil {
+		WriteErrorResponse(w, http.StatusBadRequest, []string{"counter must be a non-negative integer"})
+		return
+	}
+
+	signature, err := s.devices.GetSignature(r.PathValue("id"), counter)
+	if err != nil {
+		writeServiceError(w, err, "Failed to get signature")
+		return
 	}
 
-	return signer.Sign([]byte(data))
+	WriteAPIResponse(w, http.StatusOK, newSignatureResponse(signature))
 }
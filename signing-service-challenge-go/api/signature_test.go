@@ -0,0 +1,61 @@
+package api_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/api"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+func sign(t *testing.T, server *api.Server, deviceID, data string) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/v0/devices/"+deviceID+"/sign", bytes.NewBufferString(`{"data_to_be_signed": "`+data+`"}`))
+	server.Mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+}
+
+func TestSignatureHistory(t *testing.T) {
+	forEachStore(t, testSignatureHistory)
+}
+
+func testSignatureHistory(t *testing.T, store persistence.DeviceStore) {
+	server := setupTestServer(store)
+	sign(t, server, "00000000-0000-4000-8000-00000000000a", "first")
+	sign(t, server, "00000000-0000-4000-8000-00000000000a", "second")
+	sign(t, server, "00000000-0000-4000-8000-00000000000a", "third")
+
+	t.Run("Lists the full chain", func(t *testing.T) {
+		first := getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-00000000000a/signatures?limit=2", http.StatusOK)
+		signatures := first["signatures"].([]interface{})
+		require.Len(t, signatures, 2)
+		assert.Equal(t, float64(0), signatures[0].(map[string]interface{})["counter"])
+		assert.Contains(t, signatures[1].(map[string]interface{})["signed_data"],
+			"1_second_"+signatures[0].(map[string]interface{})["signature"].(string))
+		require.NotEmpty(t, first["next_cursor"])
+
+		second := getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-00000000000a/signatures?cursor="+first["next_cursor"].(string), http.StatusOK)
+		signatures = second["signatures"].([]interface{})
+		require.Len(t, signatures, 1)
+		assert.Equal(t, float64(2), signatures[0].(map[string]interface{})["counter"])
+		assert.NotContains(t, second, "next_cursor")
+	})
+
+	t.Run("Gets a single signature", func(t *testing.T) {
+		data := getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-00000000000a/signatures/1", http.StatusOK)
+		assert.Equal(t, float64(1), data["counter"])
+		assert.Contains(t, data["signed_data"], "1_second_")
+		assert.NotEmpty(t, data["created_at"])
+	})
+
+	t.Run("Reports unknown signatures and devices", func(t *testing.T) {
+		getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-00000000000a/signatures/3", http.StatusNotFound)
+		getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-00000000000a/signatures/abc", http.StatusBadRequest)
+		getData(t, server, "/api/v0/devices/unknown/signatures", http.StatusNotFound)
+	})
+}
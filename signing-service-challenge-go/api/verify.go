@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
+)
+
+const (
+	verifyModeSignature = "signature"
+	verifyModeChain     = "chain"
+)
+
+type verifyRequest struct {
+	Mode              string `json:"mode,omitempty"` // "signature" (default) or "chain"
+	SignedData        string `json:"signed_data,omitempty"`
+	Signature         string `json:"signature,omitempty"`           // base64 encoded
+	SecuredDataFormat int    `json:"secured_data_format,omitempty"` // of signed_data, 1 (default) or 2 like returned by sign
+}
+
+type verifyResponse struct {
+	Valid  bool   `json:"valid"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type chainAuditResponse struct {
+	Valid         bool    `json:"valid"`
+	Checked       uint64  `json:"checked"`                  // number of signatures verified successfully
+	BrokenCounter *uint64 `json:"broken_counter,omitempty"` // first counter that is missing or does not verify
+	Reason        string  `json:"reason,omitempty"`
+}
+
+// VerifySignature checks a single signature against the device's public key or,
+// in chain mode, audits the device's whole signature chain starting from counter 0.
+func (s *Server) VerifySignature(w http.ResponseWriter, r *http.Request) {
+	var req verifyRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+
+	switch req.Mode {
+	case "", verifyModeSignature:
+		result, err := s.devices.VerifySignature(r.PathValue("id"), service.VerifyParams{
+			SignedData:        req.SignedData,
+			Signature:         req.Signature,
+			SecuredDataFormat: req.SecuredDataFormat,
+		})
+		if err != nil {
+			writeServiceError(w, err, "Failed to verify signature")
+			return
+		}
+		WriteAPIResponse(w, http.StatusOK, verifyResponse{Valid: result.Valid, Reason: result.Reason})
+
+	case verifyModeChain:
+		audit, err := s.devices.AuditChain(r.PathValue("id"))
+		if err != nil {
+			writeServiceError(w, err, "Failed to audit signature chain")
+			return
+		}
+		WriteAPIResponse(w, http.StatusOK, chainAuditResponse{
+			Valid:         audit.Valid,
+			Checked:       audit.Checked,
+			BrokenCounter: audit.BrokenCounter,
+			Reason:        audit.Reason,
+		})
+
+	default:
+		WriteErrorResponse(w, http.StatusBadRequest, []string{"Unsupported verification mode"})
+	}
+}
@@ -0,0 +1,189 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/api"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+func verify(t *testing.T, server *api.Server, deviceID string, body interface{}) map[string]interface{} {
+	t.Helper()
+	reqBody, _ := json.Marshal(body)
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices/"+deviceID+"/verify", bytes.NewReader(reqBody)))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var resp api.Response
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	return resp.Data.(map[string]interface{})
+}
+
+func TestVerifySignature(t *testing.T) {
+	forEachStore(t, testVerifySignature)
+}
+
+func testVerifySignature(t *testing.T, store persistence.DeviceStore) {
+	server := setupTestServer(store)
+	sign(t, server, "00000000-0000-4000-8000-00000000000a", "first")
+	sign(t, server, "00000000-0000-4000-8000-00000000000a", "second")
+
+	signature := getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-00000000000a/signatures/1", http.StatusOK)
+
+	t.Run("Accepts a valid signature", func(t *testing.T) {
+		data := verify(t, server, "00000000-0000-4000-8000-00000000000a", map[string]string{
+			"signed_data": signature["signed_data"].(string),
+			"signature":   signature["signature"].(string),
+		})
+		assert.Equal(t, true, data["valid"])
+	})
+
+	t.Run("Rejects tampered data", func(t *testing.T) {
+		data := verify(t, server, "00000000-0000-4000-8000-00000000000a", map[string]string{
+			"signed_data": signature["signed_data"].(string) + "x",
+			"signature":   signature["signature"].(string),
+		})
+		assert.Equal(t, false, data["valid"])
+		assert.NotEmpty(t, data["reason"])
+	})
+
+	t.Run("Audits an intact chain", func(t *testing.T) {
+		data := verify(t, server, "00000000-0000-4000-8000-00000000000a", map[string]string{"mode": "chain"})
+		assert.Equal(t, true, data["valid"])
+		assert.Equal(t, float64(2), data["checked"])
+	})
+
+	t.Run("Reports the first missing counter", func(t *testing.T) {
+		device, err := store.Get("00000000-0000-4000-8000-00000000000a")
+		require.NoError(t, err)
+		device.SignatureCounter++
+		require.NoError(t, store.Update(device))
+
+		data := verify(t, server, "00000000-0000-4000-8000-00000000000a", map[string]string{"mode": "chain"})
+		assert.Equal(t, false, data["valid"])
+		assert.Equal(t, float64(2), data["broken_counter"])
+	})
+}
+
+func TestSignAndVerifyBinaryData(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store persistence.DeviceStore) {
+		server := setupTestServer(store)
+		id := "00000000-0000-4000-8000-00000000000a"
+		sign(t, server, id, "text")
+
+		rr := httptest.NewRecorder()
+		server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices/"+id+"/sign",
+			bytes.NewBufferString(`{"data_to_be_signed": "AP8A/w==", "encoding": "base64"}`)))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		signature := getData(t, server, "/api/v0/devices/"+id+"/signatures/1", http.StatusOK)
+		assert.Equal(t, float64(2), signature["secured_data_format"])
+		assert.Equal(t, float64(1), getData(t, server, "/api/v0/devices/"+id+"/signatures/0", http.StatusOK)["secured_data_format"])
+
+		data := verify(t, server, id, map[string]interface{}{
+			"signed_data":         signature["signed_data"],
+			"signature":           signature["signature"],
+			"secured_data_format": 2,
+		})
+		assert.Equal(t, true, data["valid"], data["reason"])
+
+		data = verify(t, server, id, map[string]string{"mode": "chain"})
+		assert.Equal(t, true, data["valid"], data["reason"])
+
+		rr = httptest.NewRecorder()
+		server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices/"+id+"/sign",
+			bytes.NewBufferString(`{"digest": "AP8A/w==", "digest_algorithm": "SHA256"}`)))
+		assert.Equal(t, http.StatusBadRequest, rr.Code, "the digest is too short")
+	})
+}
+
+func TestSignAndVerifySchemes(t *testing.T) {
+	server := newServer(persistence.NewInMemoryDeviceStore())
+
+	tests := []struct {
+		algorithm      string
+		scheme         string // requested, empty for the default
+		expectedScheme string
+	}{
+		{algorithm: domain.AlgorithmECC, expectedScheme: "ECDSA_P384_SHA256"},
+		{algorithm: domain.AlgorithmECC, scheme: "ECDSA_P384_SHA384", expectedScheme: "ECDSA_P384_SHA384"},
+		{algorithm: domain.AlgorithmRSA, expectedScheme: "RSA_PKCS1_SHA256"},
+		{algorithm: domain.AlgorithmRSA, scheme: "RSA_PSS_SHA512", expectedScheme: "RSA_PSS_SHA512"},
+		{algorithm: domain.AlgorithmEd25519, expectedScheme: "ED25519"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.expectedScheme, func(t *testing.T) {
+			id := fmt.Sprintf("00000000-0000-4000-8000-%012d", i)
+			reqBody, _ := json.Marshal(map[string]string{"id": id, "algorithm": tt.algorithm, "scheme": tt.scheme})
+			rr := httptest.NewRecorder()
+			server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices", bytes.NewReader(reqBody)))
+			require.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+
+			sign(t, server, id, "first")
+			sign(t, server, id, "second")
+
+			device := getData(t, server, "/api/v0/devices/"+id, http.StatusOK)
+			assert.Equal(t, tt.expectedScheme, device["scheme"])
+			signature := getData(t, server, "/api/v0/devices/"+id+"/signatures/1", http.StatusOK)
+			assert.Equal(t, tt.expectedScheme, signature["scheme"])
+
+			data := verify(t, server, id, map[string]string{"mode": "chain"})
+			assert.Equal(t, true, data["valid"], data["reason"])
+			assert.Equal(t, float64(2), data["checked"])
+		})
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	forEachStore(t, testRotateKey)
+}
+
+func testRotateKey(t *testing.T, store persistence.DeviceStore) {
+	server := newServer(store)
+	createDevice(t, server, "00000000-0000-4000-8000-000000000001", domain.AlgorithmECC, "Till 1")
+	sign(t, server, "00000000-0000-4000-8000-000000000001", "before")
+	before := getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-000000000001/signatures/0", http.StatusOK)
+	assert.Equal(t, float64(1), before["key_version"])
+
+	rr := httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices/00000000-0000-4000-8000-000000000001/rotate-key", nil))
+	require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+	var resp api.Response
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&resp))
+	device := resp.Data.(map[string]interface{})
+	assert.Equal(t, float64(2), device["key_version"])
+	assert.Equal(t, float64(1), device["signature_counter"])
+	versions := device["key_versions"].([]interface{})
+	require.Len(t, versions, 2)
+	assert.Equal(t, device["public_key"], versions[1].(map[string]interface{})["public_key"])
+	assert.Equal(t, float64(1), versions[1].(map[string]interface{})["from_counter"])
+	assert.NotEmpty(t, versions[1].(map[string]interface{})["link_signature"])
+
+	sign(t, server, "00000000-0000-4000-8000-000000000001", "after")
+	after := getData(t, server, "/api/v0/devices/00000000-0000-4000-8000-000000000001/signatures/1", http.StatusOK)
+	assert.Equal(t, float64(2), after["key_version"])
+
+	for _, signature := range []map[string]interface{}{before, after} {
+		result := verify(t, server, "00000000-0000-4000-8000-000000000001", map[string]string{
+			"signed_data": signature["signed_data"].(string),
+			"signature":   signature["signature"].(string),
+		})
+		assert.Equal(t, true, result["valid"], result["reason"])
+	}
+	audit := verify(t, server, "00000000-0000-4000-8000-000000000001", map[string]string{"mode": "chain"})
+	assert.Equal(t, true, audit["valid"], audit["reason"])
+	assert.Equal(t, float64(2), audit["checked"])
+
+	rr = httptest.NewRecorder()
+	server.Mux.ServeHTTP(rr, httptest.NewRequest("POST", "/api/v0/devices/unknown/rotate-key", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
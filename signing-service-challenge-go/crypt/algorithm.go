@@ -0,0 +1,160 @@
+package crypt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+)
+
+var ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+
+// Algorithm describes everything needed to work with the keys of one signature algorithm.
+// Keys are passed DER encoded as by DERMarshaler, the encoding stored on SignatureDevice
+// and in the key provider.
+type Algorithm struct {
+	Name           string
+	KeySizes       []int // supported key sizes in bits
+	DefaultKeySize int
+
+	// GenerateKey creates a key pair of one of the KeySizes.
+	GenerateKey func(keySize int) (publicKey []byte, privateKey []byte, err error)
+	// DefaultScheme returns the name of the scheme devices sign with if they did not choose one.
+	DefaultScheme func(keySize int) string
+	// NewSigner and NewVerifier are called with schemes of this algorithm only.
+	NewSigner   func(privateKey []byte, scheme SignatureScheme) (Signer, error)
+	NewVerifier func(publicKey []byte, scheme SignatureScheme) (Verifier, error)
+}
+
+var (
+	algorithms      = make(map[string]Algorithm)
+	algorithmsMutex sync.RWMutex
+)
+
+// RegisterAlgorithm makes an algorithm available under its name. It panics if the name is taken.
+func RegisterAlgorithm(algorithm Algorithm) {
+	algorithmsMutex.Lock()
+	defer algorithmsMutex.Unlock()
+
+	if _, exists := algorithms[algorithm.Name]; exists {
+		panic("crypt: algorithm registered twice: " + algorithm.Name)
+	}
+	algorithms[algorithm.Name] = algorithm
+}
+
+// LookupAlgorithm returns the registered algorithm with the name.
+func LookupAlgorithm(name string) (Algorithm, error) {
+	algorithmsMutex.RLock()
+	defer algorithmsMutex.RUnlock()
+
+	algorithm, exists := algorithms[name]
+	if !exists {
+		return Algorithm{}, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, name)
+	}
+	return algorithm, nil
+}
+
+// AlgorithmNames returns the names of all registered algorithms in alphabetical order.
+func AlgorithmNames() []string {
+	algorithmsMutex.RLock()
+	defer algorithmsMutex.RUnlock()
+
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterAlgorithm(Algorithm{
+		Name:           domain.AlgorithmRSA,
+		KeySizes:       RSAKeySizes,
+		DefaultKeySize: DefaultRSAKeySize,
+		GenerateKey: func(keySize int) ([]byte, []byte, error) {
+			generator := RSAGenerator{Bits: keySize}
+			keyPair, err := generator.Generate()
+			if err != nil {
+				return nil, nil, err
+			}
+			return DERMarshaler{}.Encode(keyPair.KeyPair())
+		},
+		DefaultScheme: func(int) string { return "RSA_PKCS1_SHA256" },
+		NewSigner: func(privateKey []byte, scheme SignatureScheme) (Signer, error) {
+			signer, err := NewRSAKeySigner(privateKey)
+			if err != nil {
+				return nil, err
+			}
+			signer.hash, signer.pss = scheme.Hash, scheme.PSS
+			return signer, nil
+		},
+		NewVerifier: func(publicKey []byte, scheme SignatureScheme) (Verifier, error) {
+			verifier, err := NewRSAKeyVerifier(publicKey)
+			if err != nil {
+				return nil, err
+			}
+			verifier.hash, verifier.pss = scheme.Hash, scheme.PSS
+			return verifier, nil
+		},
+	})
+
+	RegisterAlgorithm(Algorithm{
+		Name:           domain.AlgorithmECC,
+		KeySizes:       ECCKeySizes,
+		DefaultKeySize: DefaultECCKeySize,
+		GenerateKey: func(keySize int) ([]byte, []byte, error) {
+			curve, err := ECCCurve(keySize)
+			if err != nil {
+				return nil, nil, err
+			}
+			generator := ECCGenerator{Curve: curve}
+			keyPair, err := generator.Generate()
+			if err != nil {
+				return nil, nil, err
+			}
+			return DERMarshaler{}.Encode(keyPair.KeyPair())
+		},
+		// Signatures have always been hashed with SHA-256, regardless of the curve.
+		DefaultScheme: func(keySize int) string { return fmt.Sprintf("ECDSA_P%d_SHA256", keySize) },
+		NewSigner: func(privateKey []byte, scheme SignatureScheme) (Signer, error) {
+			signer, err := NewECCKeySigner(privateKey)
+			if err != nil {
+				return nil, err
+			}
+			signer.hash = scheme.Hash
+			return signer, nil
+		},
+		NewVerifier: func(publicKey []byte, scheme SignatureScheme) (Verifier, error) {
+			verifier, err := NewECCKeyVerifier(publicKey)
+			if err != nil {
+				return nil, err
+			}
+			verifier.hash = scheme.Hash
+			return verifier, nil
+		},
+	})
+
+	RegisterAlgorithm(Algorithm{
+		Name:           domain.AlgorithmEd25519,
+		KeySizes:       []int{256},
+		DefaultKeySize: 256,
+		GenerateKey: func(int) ([]byte, []byte, error) {
+			generator := Ed25519Generator{}
+			keyPair, err := generator.Generate()
+			if err != nil {
+				return nil, nil, err
+			}
+			return DERMarshaler{}.Encode(keyPair.KeyPair())
+		},
+		DefaultScheme: func(int) string { return "ED25519" },
+		NewSigner: func(privateKey []byte, _ SignatureScheme) (Signer, error) {
+			return NewEd25519KeySigner(privateKey)
+		},
+		NewVerifier: func(publicKey []byte, _ SignatureScheme) (Verifier, error) {
+			return NewEd25519KeyVerifier(publicKey)
+		},
+	})
+}
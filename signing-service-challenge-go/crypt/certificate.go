@@ -0,0 +1,135 @@
+package crypt
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	pemTypeCertificate        = "CERTIFICATE"
+	pemTypeCertificateRequest = "CERTIFICATE REQUEST"
+)
+
+var (
+	ErrMalformedCertificate = errors.New("malformed certificate")
+	ErrCertificateMismatch  = errors.New("certificate does not match")
+)
+
+// x509SignatureAlgorithm returns the X.509 signature algorithm of a scheme, so certificates
+// and requests are signed the same way as the device's transactions.
+func x509SignatureAlgorithm(scheme SignatureScheme) (x509.SignatureAlgorithm, error) {
+	if scheme.X509SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("%w: %s has no X.509 signature algorithm", ErrUnsupportedScheme, scheme.Name)
+	}
+	return scheme.X509SignatureAlgorithm, nil
+}
+
+// SelfSignedCertificate issues a DER encoded end-entity certificate for the key of signer,
+// signed by that key with scheme. The certificate is valid for signatures only.
+func SelfSignedCertificate(signer crypto.Signer, scheme SignatureScheme, subject pkix.Name, notBefore, notAfter time.Time) ([]byte, error) {
+	signatureAlgorithm, err := x509SignatureAlgorithm(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 5280 allows serial numbers of up to 20 bytes, 127 random bits stay positive and below that.
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               subject,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    signatureAlgorithm,
+	}
+	return x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+}
+
+// CertificateRequest creates a DER encoded PKCS#10 certificate signing request for the key of
+// signer, signed by that key with scheme.
+func CertificateRequest(signer crypto.Signer, scheme SignatureScheme, subject pkix.Name) ([]byte, error) {
+	signatureAlgorithm, err := x509SignatureAlgorithm(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.CertificateRequest{
+		Subject:            subject,
+		SignatureAlgorithm: signatureAlgorithm,
+	}
+	return x509.CreateCertificateRequest(rand.Reader, template, signer)
+}
+
+// EncodeCertificates PEM encodes DER certificates into a chain.
+func EncodeCertificates(certificates ...[]byte) []byte {
+	var chain []byte
+	for _, certificate := range certificates {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: pemTypeCertificate, Bytes: certificate})...)
+	}
+	return chain
+}
+
+// EncodeCertificateRequest PEM encodes a DER certificate signing request.
+func EncodeCertificateRequest(request []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypeCertificateRequest, Bytes: request})
+}
+
+// ParseCertificateChain decodes a PEM encoded certificate chain. It must contain at least one
+// certificate and nothing else but certificates.
+func ParseCertificateChain(chain []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, chain = pem.Decode(chain)
+		if block == nil {
+			break
+		}
+		if block.Type != pemTypeCertificate {
+			return nil, fmt.Errorf("%w: unexpected PEM block %q", ErrMalformedCertificate, block.Type)
+		}
+
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMalformedCertificate, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("%w: no PEM encoded certificate found", ErrMalformedCertificate)
+	}
+	return certificates, nil
+}
+
+// VerifyCertificateChain checks that the first certificate of chain is issued for publicKey and
+// each certificate is signed by the next one. It does not check validity periods or trust in
+// the last certificate, that is up to whoever relies on the chain.
+func VerifyCertificateChain(chain []*x509.Certificate, publicKey crypto.PublicKey) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("%w: empty certificate chain", ErrMalformedCertificate)
+	}
+
+	leafKey, ok := chain[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !leafKey.Equal(publicKey) {
+		return fmt.Errorf("%w: the first certificate is not issued for the device key", ErrCertificateMismatch)
+	}
+
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return fmt.Errorf("%w: certificate %d is not signed by certificate %d: %v", ErrCertificateMismatch, i, i+1, err)
+		}
+	}
+	return nil
+}
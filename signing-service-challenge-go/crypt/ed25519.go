@@ -0,0 +1,87 @@
+package crypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+)
+
+// Ed25519KeyPair is a DTO that holds Ed25519 private and public keys.
+type Ed25519KeyPair struct {
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+// Ed25519Generator generates an Ed25519 key pair.
+type Ed25519Generator struct{}
+
+// Generate generates a new Ed25519KeyPair.
+func (g *Ed25519Generator) Generate() (*Ed25519KeyPair, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ed25519KeyPair{
+		Public:  public,
+		Private: private,
+	}, nil
+}
+
+// KeyPair converts the key pair for use with a KeyMarshaler.
+func (k Ed25519KeyPair) KeyPair() KeyPair {
+	return KeyPair{Public: k.Public, Private: k.Private}
+}
+
+// Ed25519KeySigner implements Signer for Ed25519 keys.
+// Ed25519 hashes the data itself, so it is signed as is.
+type Ed25519KeySigner struct {
+	privateKey ed25519.PrivateKey
+}
+
+// NewEd25519KeySigner creates a signer from a PKCS#8 encoded Ed25519 private key.
+func NewEd25519KeySigner(privateKeyBytes []byte) (*Ed25519KeySigner, error) {
+	key, err := decodePrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	privKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an Ed25519 private key", ErrMalformedKey)
+	}
+	return &Ed25519KeySigner{privateKey: privKey}, nil
+}
+
+func (s *Ed25519KeySigner) Sign(dataToBeSigned []byte) ([]byte, error) {
+	return ed25519.Sign(s.privateKey, dataToBeSigned), nil
+}
+
+// Ed25519KeyVerifier implements Verifier for Ed25519 keys.
+type Ed25519KeyVerifier struct {
+	publicKey ed25519.PublicKey
+}
+
+// NewEd25519KeyVerifier creates a verifier from a PKIX encoded Ed25519 public key,
+// as stored in SignatureDevice.PublicKey.
+func NewEd25519KeyVerifier(publicKeyBytes []byte) (*Ed25519KeyVerifier, error) {
+	key, err := DERMarshaler{}.DecodePublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an Ed25519 public key", ErrMalformedKey)
+	}
+	return &Ed25519KeyVerifier{publicKey: pubKey}, nil
+}
+
+func (v *Ed25519KeyVerifier) Verify(data []byte, signature []byte) error {
+	if len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrMalformedSignature, ed25519.SignatureSize, len(signature))
+	}
+
+	if !ed25519.Verify(v.publicKey, data, signature) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
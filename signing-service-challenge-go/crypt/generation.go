@@ -5,15 +5,51 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"fmt"
 )
 
+const (
+	DefaultRSAKeySize = 2048
+	DefaultECCKeySize = 384
+)
+
+// RSAKeySizes are the supported sizes of the RSA modulus in bits. Sizes below 1024 bits are
+// only generated if the Go runtime runs with GODEBUG=rsa1024min=0.
+var RSAKeySizes = []int{512, 1024, 2048, 3072, 4096}
+
+// ECCKeySizes are the sizes of the supported NIST curves in bits, see ECCCurve.
+var ECCKeySizes = []int{256, 384, 521}
+
+var ErrUnsupportedKeySize = errors.New("unsupported key size")
+
+// ECCCurve returns the NIST curve with the given size in bits.
+func ECCCurve(size int) (elliptic.Curve, error) {
+	switch size {
+	case 256:
+		return elliptic.P256(), nil
+	case 384:
+		return elliptic.P384(), nil
+	case 521:
+		return elliptic.P521(), nil
+	default:
+		return nil, fmt.Errorf("%w: no curve with %d bits", ErrUnsupportedKeySize, size)
+	}
+}
+
 // RSAGenerator generates a RSA key pair.
-type RSAGenerator struct{}
+type RSAGenerator struct {
+	Bits int // size of the modulus, 0 means DefaultRSAKeySize
+}
 
 // Generate generates a new RSAKeyPair.
 func (g *RSAGenerator) Generate() (*RSAKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := rsa.GenerateKey(rand.Reader, 512)
+	bits := g.Bits
+	if bits == 0 {
+		bits = DefaultRSAKeySize
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return nil, err
 	}
@@ -25,12 +61,18 @@ func (g *RSAGenerator) Generate() (*RSAKeyPair, error) {
 }
 
 // ECCGenerator generates an ECC key pair.
-type ECCGenerator struct{}
+type ECCGenerator struct {
+	Curve elliptic.Curve // nil means the curve of DefaultECCKeySize
+}
 
 // Generate generates a new ECCKeyPair.
 func (g *ECCGenerator) Generate() (*ECCKeyPair, error) {
-	// Security has been ignored for the sake of simplicity.
-	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	curve := g.Curve
+	if curve == nil {
+		curve = elliptic.P384()
+	}
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,60 @@
+package crypt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a public key in the JSON Web Key format of RFC 7517.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"` // RSA modulus
+	E         string `json:"e,omitempty"` // RSA public exponent
+	X         string `json:"x,omitempty"` // EC x coordinate or OKP public key
+	Y         string `json:"y,omitempty"` // EC y coordinate
+}
+
+// JWKSet is a set of keys in the format of RFC 7517, section 5.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK converts a public key into a JWK for signature verification.
+// All values are base64url encoded without padding as required by RFC 7518.
+func NewJWK(publicKey crypto.PublicKey, keyID string, scheme SignatureScheme) (JWK, error) {
+	jwk := JWK{KeyID: keyID, Use: "sig", Algorithm: scheme.JWSAlgorithm}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encodeJWKValue(key.N.Bytes())
+		jwk.E = encodeJWKValue(big.NewInt(int64(key.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = key.Curve.Params().Name
+		jwk.X = encodeJWKValue(key.X.FillBytes(make([]byte, size)))
+		jwk.Y = encodeJWKValue(key.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encodeJWKValue(key)
+	default:
+		return JWK{}, fmt.Errorf("%w: %T cannot be converted to a JWK", ErrMalformedKey, publicKey)
+	}
+
+	return jwk, nil
+}
+
+func encodeJWKValue(value []byte) string {
+	return base64.RawURLEncoding.EncodeToString(value)
+}
@@ -0,0 +1,108 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KEKSize is the size of a key-encryption key, it selects AES-256.
+const KEKSize = 32
+
+// wrappedKeyMagic starts every wrapped key. DER encoded keys start with 0x30,
+// so wrapped and plain keys cannot be confused.
+var wrappedKeyMagic = []byte("KW1")
+
+var (
+	ErrWrongKEK        = errors.New("key was wrapped with a different key-encryption key")
+	ErrKeyUnwrapFailed = errors.New("key could not be unwrapped")
+)
+
+// KeyWrapper encrypts private keys at rest with AES-GCM under a key-encryption key (KEK).
+// The ID of the key is used as associated data, so a wrapped key cannot be passed off as another
+// one. That is the handle for keys in the key token, and the device ID for keys that were stored
+// on their devices before the key token existed.
+//
+// A wrapped key is laid out as: magic | KEK ID (8 bytes) | nonce | ciphertext.
+type KeyWrapper struct {
+	aead  cipher.AEAD
+	kekID []byte
+}
+
+// NewKeyWrapper creates a KeyWrapper from a KEKSize bytes long key-encryption key.
+func NewKeyWrapper(kek []byte) (*KeyWrapper, error) {
+	if len(kek) != KEKSize {
+		return nil, fmt.Errorf("key-encryption key must be %d bytes, got %d", KEKSize, len(kek))
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ID identifies the KEK without revealing it.
+	fingerprint := sha256.Sum256(append([]byte("kek-id:"), kek...))
+	return &KeyWrapper{aead: aead, kekID: fingerprint[:8]}, nil
+}
+
+// ParseKEK decodes a base64 encoded key-encryption key, as found in a file or environment variable.
+func ParseKEK(encoded string) ([]byte, error) {
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key-encryption key is not valid base64: %w", err)
+	}
+	return kek, nil
+}
+
+// IsWrappedKey reports whether key was produced by a KeyWrapper.
+func IsWrappedKey(key []byte) bool {
+	return bytes.HasPrefix(key, wrappedKeyMagic)
+}
+
+// Wrap encrypts the private key with the ID.
+func (w *KeyWrapper) Wrap(keyID string, privateKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	wrapped := make([]byte, 0, len(wrappedKeyMagic)+len(w.kekID)+len(nonce)+len(privateKey)+w.aead.Overhead())
+	wrapped = append(wrapped, wrappedKeyMagic...)
+	wrapped = append(wrapped, w.kekID...)
+	wrapped = append(wrapped, nonce...)
+	return w.aead.Seal(wrapped, nonce, privateKey, []byte(keyID)), nil
+}
+
+// Unwrap decrypts a private key wrapped with the ID.
+func (w *KeyWrapper) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	if !IsWrappedKey(wrapped) {
+		return nil, fmt.Errorf("%w: not a wrapped key", ErrKeyUnwrapFailed)
+	}
+
+	rest := wrapped[len(wrappedKeyMagic):]
+	if len(rest) < len(w.kekID)+w.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: wrapped key is truncated", ErrKeyUnwrapFailed)
+	}
+	if !bytes.Equal(rest[:len(w.kekID)], w.kekID) {
+		return nil, ErrWrongKEK
+	}
+
+	rest = rest[len(w.kekID):]
+	nonce, ciphertext := rest[:w.aead.NonceSize()], rest[w.aead.NonceSize():]
+	privateKey, err := w.aead.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeyUnwrapFailed, err)
+	}
+
+	return privateKey, nil
+}
@@ -0,0 +1,142 @@
+package crypt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+const (
+	pemTypePublicKey  = "PUBLIC KEY"
+	pemTypePrivateKey = "PRIVATE KEY"
+)
+
+// KeyPair holds the keys of any supported algorithm.
+type KeyPair struct {
+	Public  crypto.PublicKey
+	Private crypto.Signer
+}
+
+// KeyMarshaler encodes key pairs of all supported algorithms and decodes them again.
+//
+// Keys are encoded as PKIX (public) and PKCS#8 (private). For keys stored by earlier versions,
+// decoding also accepts PKCS#1 RSA keys, SEC1 ECC private keys and raw uncompressed ECC points.
+type KeyMarshaler interface {
+	// Encode returns the encoded public and private key.
+	Encode(keyPair KeyPair) (publicKey []byte, privateKey []byte, err error)
+	// EncodePublicKey encodes only a public key, for handing it out.
+	EncodePublicKey(publicKey crypto.PublicKey) ([]byte, error)
+	// Decode assembles a key pair from an encoded private key.
+	Decode(privateKey []byte) (*KeyPair, error)
+	// DecodePublicKey decodes an encoded public key.
+	DecodePublicKey(publicKey []byte) (crypto.PublicKey, error)
+}
+
+// DERMarshaler is a KeyMarshaler for plain DER, the encoding of keys in storage.
+type DERMarshaler struct{}
+
+// PEMMarshaler is a KeyMarshaler for PEM with the standard "PUBLIC KEY" and "PRIVATE KEY" labels,
+// the encoding of keys written to disk or handed out. The labels of decoded blocks are not checked,
+// so blocks with the legacy labels like "RSA_PRIVATE_KEY" are accepted as well.
+type PEMMarshaler struct{}
+
+func (DERMarshaler) Encode(keyPair KeyPair) ([]byte, []byte, error) {
+	publicKey, err := x509.MarshalPKIXPublicKey(keyPair.Public)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKey, err := x509.MarshalPKCS8PrivateKey(keyPair.Private)
+	if err != nil {
+		return nil, nil, err
+	}
+	return publicKey, privateKey, nil
+}
+
+func (DERMarshaler) EncodePublicKey(publicKey crypto.PublicKey) ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(publicKey)
+}
+
+func (DERMarshaler) Decode(privateKeyBytes []byte) (*KeyPair, error) {
+	privateKey, err := decodePrivateKey(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Public: privateKey.Public(), Private: privateKey}, nil
+}
+
+func (DERMarshaler) DecodePublicKey(publicKeyBytes []byte) (crypto.PublicKey, error) {
+	if key, err := x509.ParsePKIXPublicKey(publicKeyBytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(publicKeyBytes); err == nil {
+		return key, nil
+	}
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if x, y := elliptic.Unmarshal(curve, publicKeyBytes); x != nil {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: not a PKIX, PKCS#1 or raw ECC public key", ErrMalformedKey)
+}
+
+func decodePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("%w: unsupported private key type %T", ErrMalformedKey, key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: not a PKCS#8, PKCS#1 or SEC1 private key", ErrMalformedKey)
+}
+
+func (PEMMarshaler) Encode(keyPair KeyPair) ([]byte, []byte, error) {
+	publicKey, privateKey, err := DERMarshaler{}.Encode(keyPair)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encodedPublic := pem.EncodeToMemory(&pem.Block{Type: pemTypePublicKey, Bytes: publicKey})
+	encodedPrivate := pem.EncodeToMemory(&pem.Block{Type: pemTypePrivateKey, Bytes: privateKey})
+	return encodedPublic, encodedPrivate, nil
+}
+
+func (PEMMarshaler) EncodePublicKey(publicKey crypto.PublicKey) ([]byte, error) {
+	der, err := DERMarshaler{}.EncodePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypePublicKey, Bytes: der}), nil
+}
+
+func (PEMMarshaler) Decode(privateKeyBytes []byte) (*KeyPair, error) {
+	block, err := decodePEM(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return DERMarshaler{}.Decode(block.Bytes)
+}
+
+func (PEMMarshaler) DecodePublicKey(publicKeyBytes []byte) (crypto.PublicKey, error) {
+	block, err := decodePEM(publicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return DERMarshaler{}.DecodePublicKey(block.Bytes)
+}
+
+func decodePEM(data []byte) (*pem.Block, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrMalformedKey)
+	}
+	return block, nil
+}
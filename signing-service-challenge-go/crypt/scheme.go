@@ -0,0 +1,154 @@
+package crypt
+
+import (
+	"crypto"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for crypto.Hash
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+)
+
+var ErrUnsupportedScheme = errors.New("unsupported signature scheme")
+
+// SignatureScheme is the combination of algorithm, padding and hash function a device signs with,
+// like RSA_PSS_SHA256 or ECDSA_P384_SHA384.
+type SignatureScheme struct {
+	Name      string
+	Algorithm string
+	KeySize   int         // the only key size the scheme works with, 0 for all sizes of the algorithm
+	Hash      crypto.Hash // 0 if the algorithm hashes the data itself
+	PSS       bool        // RSA only, PSS instead of PKCS#1 v1.5 padding
+
+	// JWSAlgorithm is the "alg" of RFC 7518 for the same algorithm, padding and hash,
+	// empty if there is none (like for ECDSA with a hash that does not match the curve).
+	JWSAlgorithm string
+	// X509SignatureAlgorithm signs certificates and requests the same way as transactions,
+	// x509.UnknownSignatureAlgorithm if there is none.
+	X509SignatureAlgorithm x509.SignatureAlgorithm
+}
+
+var (
+	schemes      = make(map[string]SignatureScheme)
+	schemesMutex sync.RWMutex
+)
+
+// RegisterScheme makes a scheme available under its name. It panics if the name is taken.
+func RegisterScheme(scheme SignatureScheme) {
+	schemesMutex.Lock()
+	defer schemesMutex.Unlock()
+
+	if _, exists := schemes[scheme.Name]; exists {
+		panic("crypt: signature scheme registered twice: " + scheme.Name)
+	}
+	schemes[scheme.Name] = scheme
+}
+
+// LookupScheme returns the registered scheme with the name.
+func LookupScheme(name string) (SignatureScheme, error) {
+	schemesMutex.RLock()
+	defer schemesMutex.RUnlock()
+
+	scheme, exists := schemes[name]
+	if !exists {
+		return SignatureScheme{}, fmt.Errorf("%w: %s", ErrUnsupportedScheme, name)
+	}
+	return scheme, nil
+}
+
+// SchemeNames returns the names of all registered schemes in alphabetical order.
+func SchemeNames() []string {
+	schemesMutex.RLock()
+	defer schemesMutex.RUnlock()
+
+	names := make([]string, 0, len(schemes))
+	for name := range schemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSigner creates a signer for the private key that signs according to the scheme.
+func NewSigner(scheme SignatureScheme, privateKey []byte) (Signer, error) {
+	algorithm, err := LookupAlgorithm(scheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return algorithm.NewSigner(privateKey, scheme)
+}
+
+// NewVerifier creates a verifier for the public key that checks signatures of the scheme.
+func NewVerifier(scheme SignatureScheme, publicKey []byte) (Verifier, error) {
+	algorithm, err := LookupAlgorithm(scheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return algorithm.NewVerifier(publicKey, scheme)
+}
+
+var hashNames = map[crypto.Hash]string{
+	crypto.SHA256: "SHA256",
+	crypto.SHA384: "SHA384",
+	crypto.SHA512: "SHA512",
+}
+
+// x509Algorithms are the X.509 signature algorithms of each hash with RSA and ECDSA.
+var x509Algorithms = map[crypto.Hash]struct{ pkcs1, pss, ecdsa x509.SignatureAlgorithm }{
+	crypto.SHA256: {x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.ECDSAWithSHA256},
+	crypto.SHA384: {x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384},
+	crypto.SHA512: {x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512},
+}
+
+// jwsECDSACurves are the curves JWS defines an ECDSA algorithm for, by hash.
+var jwsECDSACurves = map[crypto.Hash]int{
+	crypto.SHA256: 256,
+	crypto.SHA384: 384,
+	crypto.SHA512: 521,
+}
+
+func init() {
+	for hash, hashName := range hashNames {
+		bits := hashName[len("SHA"):]
+		RegisterScheme(SignatureScheme{
+			Name:                   "RSA_PKCS1_" + hashName,
+			Algorithm:              domain.AlgorithmRSA,
+			Hash:                   hash,
+			JWSAlgorithm:           "RS" + bits,
+			X509SignatureAlgorithm: x509Algorithms[hash].pkcs1,
+		})
+		RegisterScheme(SignatureScheme{
+			Name:                   "RSA_PSS_" + hashName,
+			Algorithm:              domain.AlgorithmRSA,
+			Hash:                   hash,
+			PSS:                    true,
+			JWSAlgorithm:           "PS" + bits,
+			X509SignatureAlgorithm: x509Algorithms[hash].pss,
+		})
+
+		for _, keySize := range ECCKeySizes {
+			scheme := SignatureScheme{
+				Name:                   fmt.Sprintf("ECDSA_P%d_%s", keySize, hashName),
+				Algorithm:              domain.AlgorithmECC,
+				KeySize:                keySize,
+				Hash:                   hash,
+				X509SignatureAlgorithm: x509Algorithms[hash].ecdsa,
+			}
+			if jwsECDSACurves[hash] == keySize {
+				scheme.JWSAlgorithm = "ES" + bits
+			}
+			RegisterScheme(scheme)
+		}
+	}
+
+	RegisterScheme(SignatureScheme{
+		Name:                   "ED25519",
+		Algorithm:              domain.AlgorithmEd25519,
+		JWSAlgorithm:           "EdDSA",
+		X509SignatureAlgorithm: x509.PureEd25519,
+	})
+}
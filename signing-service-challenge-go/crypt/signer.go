@@ -5,8 +5,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
-	"crypto/x509"
+	"fmt"
 )
 
 // Signer defines a contract for different types of signing implementations.
@@ -17,35 +16,58 @@ type Signer interface {
 // RSAKeySigner implements Signer for RSA keys
 type RSAKeySigner struct {
 	privateKey *rsa.PrivateKey
+	hash       crypto.Hash
+	pss        bool
 }
 
+// NewRSAKeySigner creates a signer from a DER encoded RSA private key, see KeyMarshaler,
+// that uses PKCS#1 v1.5 padding and SHA-256. Use NewSigner for other schemes.
 func NewRSAKeySigner(privateKeyBytes []byte) (*RSAKeySigner, error) {
-	privKey, err := x509.ParsePKCS1PrivateKey(privateKeyBytes)
+	key, err := decodePrivateKey(privateKeyBytes)
 	if err != nil {
 		return nil, err
 	}
-	return &RSAKeySigner{privateKey: privKey}, nil
+	privKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an RSA private key", ErrMalformedKey)
+	}
+	return &RSAKeySigner{privateKey: privKey, hash: crypto.SHA256}, nil
 }
 
 func (s *RSAKeySigner) Sign(dataToBeSigned []byte) ([]byte, error) {
-	hashed := sha256.Sum256(dataToBeSigned)
-	return rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA256, hashed[:])
+	hashed := digest(s.hash, dataToBeSigned)
+	if s.pss {
+		return rsa.SignPSS(rand.Reader, s.privateKey, s.hash, hashed, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	}
+	return rsa.SignPKCS1v15(rand.Reader, s.privateKey, s.hash, hashed)
 }
 
 // ECCKeySigner implements Signer for ECC keys
 type ECCKeySigner struct {
 	privateKey *ecdsa.PrivateKey
+	hash       crypto.Hash
 }
 
+// NewECCKeySigner creates a signer from a DER encoded ECC private key, see KeyMarshaler,
+// that hashes with SHA-256. Use NewSigner for other schemes.
 func NewECCKeySigner(privateKeyBytes []byte) (*ECCKeySigner, error) {
-	privKey, err := x509.ParseECPrivateKey(privateKeyBytes)
+	key, err := decodePrivateKey(privateKeyBytes)
 	if err != nil {
 		return nil, err
 	}
-	return &ECCKeySigner{privateKey: privKey}, nil
+	privKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an ECC private key", ErrMalformedKey)
+	}
+	return &ECCKeySigner{privateKey: privKey, hash: crypto.SHA256}, nil
 }
 
 func (s *ECCKeySigner) Sign(dataToBeSigned []byte) ([]byte, error) {
-	hashed := sha256.Sum256(dataToBeSigned)
-	return ecdsa.SignASN1(rand.Reader, s.privateKey, hashed[:])
+	return ecdsa.SignASN1(rand.Reader, s.privateKey, digest(s.hash, dataToBeSigned))
+}
+
+func digest(hash crypto.Hash, data []byte) []byte {
+	h := hash.New()
+	h.Write(data)
+	return h.Sum(nil)
 }
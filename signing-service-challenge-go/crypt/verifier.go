@@ -0,0 +1,99 @@
+package crypt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	ErrMalformedKey       = errors.New("malformed key")
+	ErrMalformedSignature = errors.New("malformed signature")
+	ErrSignatureMismatch  = errors.New("signature does not match")
+)
+
+// Verifier defines a contract for checking signatures created by a Signer.
+// Verify returns nil for a valid signature, ErrMalformedSignature if the signature
+// cannot be decoded and ErrSignatureMismatch if it does not match the data.
+type Verifier interface {
+	Verify(data []byte, signature []byte) error
+}
+
+// RSAKeyVerifier implements Verifier for RSA keys
+type RSAKeyVerifier struct {
+	publicKey *rsa.PublicKey
+	hash      crypto.Hash
+	pss       bool
+}
+
+// NewRSAKeyVerifier creates a verifier from a DER encoded RSA public key, as stored in
+// SignatureDevice.PublicKey, for PKCS#1 v1.5 padding and SHA-256. Use NewVerifier for other schemes.
+func NewRSAKeyVerifier(publicKeyBytes []byte) (*RSAKeyVerifier, error) {
+	key, err := DERMarshaler{}.DecodePublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an RSA public key", ErrMalformedKey)
+	}
+	return &RSAKeyVerifier{publicKey: pubKey, hash: crypto.SHA256}, nil
+}
+
+func (v *RSAKeyVerifier) Verify(data []byte, signature []byte) error {
+	if len(signature) != v.publicKey.Size() {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrMalformedSignature, v.publicKey.Size(), len(signature))
+	}
+
+	hashed := digest(v.hash, data)
+	var err error
+	if v.pss {
+		err = rsa.VerifyPSS(v.publicKey, v.hash, hashed, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	} else {
+		err = rsa.VerifyPKCS1v15(v.publicKey, v.hash, hashed, signature)
+	}
+	if err != nil {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
+
+// ECCKeyVerifier implements Verifier for ECC keys
+type ECCKeyVerifier struct {
+	publicKey *ecdsa.PublicKey
+	hash      crypto.Hash
+}
+
+// NewECCKeyVerifier creates a verifier from a DER encoded ECC public key, as stored in
+// SignatureDevice.PublicKey, for SHA-256. Use NewVerifier for other schemes.
+// Devices created by earlier versions store the raw uncompressed point, which is accepted too.
+func NewECCKeyVerifier(publicKeyBytes []byte) (*ECCKeyVerifier, error) {
+	key, err := DERMarshaler{}.DecodePublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an ECC public key", ErrMalformedKey)
+	}
+	return &ECCKeyVerifier{publicKey: pubKey, hash: crypto.SHA256}, nil
+}
+
+func (v *ECCKeyVerifier) Verify(data []byte, signature []byte) error {
+	var parsed struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(signature, &parsed)
+	if err != nil || len(rest) > 0 || parsed.R.Sign() <= 0 || parsed.S.Sign() <= 0 {
+		return fmt.Errorf("%w: not an ASN.1 encoded ECDSA signature", ErrMalformedSignature)
+	}
+
+	if !ecdsa.VerifyASN1(v.publicKey, digest(v.hash, data), signature) {
+		return ErrSignatureMismatch
+	}
+	return nil
+}
@@ -1,16 +1,50 @@
 package domain
 
+import "time"
+
+const (
+	AlgorithmECC     string = "ECC"
+	AlgorithmRSA     string = "RSA"
+	AlgorithmEd25519 string = "ED25519"
+)
+
+// Lifecycle states of a device. Only active devices sign. A suspended device can be reactivated,
+// a decommissioned one has its private key destroyed and stays decommissioned.
 const (
-	AlgorithmECC string = "ECC"
-	AlgorithmRSA string = "RSA"
+	StatusActive         string = "ACTIVE"
+	StatusSuspended      string = "SUSPENDED"
+	StatusDecommissioned string = "DECOMMISSIONED"
 )
 
 type SignatureDevice struct {
-	ID               string
-	Label            string
-	Algorithm        string // could be of "Algorithm" type providing "enum-like" properties if desired
-	PublicKey        []byte
+	ID        string
+	Label     string
+	Algorithm string // could be of "Algorithm" type providing "enum-like" properties if desired
+	KeySize   int    // bits of the RSA modulus or the ECC curve, 0 if unknown (created before it was recorded)
+	PublicKey []byte
+	KeyHandle string // references the private key in the key provider, empty once it is destroyed
+	// PrivateKey is only set on devices created before private keys moved to the key provider,
+	// possibly wrapped with the device ID. It is cleared once the key has been imported.
 	PrivateKey       []byte
+	Scheme           string // signature scheme like RSA_PSS_SHA256, empty means the algorithm's default
+	Status           string // lifecycle state, empty means active (created before states existed)
 	SignatureCounter uint64
 	LastSignature    string
+	CertificateChain []byte       // PEM encoded X.509 certificates, the device's first, empty if it has none
+	KeyVersions      []KeyVersion // all keys of the device in order, the last is the current one; empty if never recorded
+	// TransactionSchema names the schema the device's transactions must follow, empty if they are free-form.
+	TransactionSchema string
+}
+
+// KeyVersion is one of the keys a device signed with. A key signs the counters from FromCounter
+// up to the FromCounter of the next version. Every key but the first is linked to its predecessor
+// by a signature of the previous key over the new public key.
+type KeyVersion struct {
+	Version       int // starting at 1
+	PublicKey     []byte
+	KeySize       int
+	Scheme        string
+	FromCounter   uint64
+	LinkSignature string // base64 encoded, empty for the first version
+	CreatedAt     time.Time
 }
@@ -0,0 +1,13 @@
+package domain
+
+import "time"
+
+// IdempotencyKey records a signing request under the key the client sent with it,
+// so a retry gets the signature of the first attempt instead of a second one.
+type IdempotencyKey struct {
+	DeviceID    string
+	Key         string
+	RequestHash string // hex encoded SHA-256 of the request, to detect a key reused for another request
+	Counter     uint64 // the signature created for the request
+	CreatedAt   time.Time
+}
@@ -0,0 +1,16 @@
+package domain
+
+import "time"
+
+// Signature is the record of a single transaction signed by a device.
+// Together the records of a device form its signature chain.
+type Signature struct {
+	DeviceID   string
+	Counter    uint64 // value of the device's signature counter when signing
+	Signature  string // base64 encoded
+	Scheme     string // signature scheme used, empty for signatures created before it was recorded
+	KeyVersion int    // version of the device key used, 0 for signatures created before keys were rotated
+	DataFormat int    // version of the secured data format, 0 for signatures created before it was recorded
+	SignedData string // the secured data that was signed, base64 encoded if the format is binary
+	CreatedAt  time.Time
+}
@@ -0,0 +1,36 @@
+// Package keys manages the private keys of signature devices. Keys are addressed by an opaque
+// handle, like the objects in a slot of a hardware security module, and their private part
+// never leaves the KeyProvider.
+package keys
+
+import (
+	"crypto"
+	"errors"
+)
+
+var (
+	ErrKeyNotFound          = errors.New("key not found")
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+	ErrUnsupportedScheme    = errors.New("unsupported signature scheme")
+	ErrKEKRequired          = errors.New("keys are encrypted, their key-encryption key is required")
+)
+
+// KeyProvider generates, uses and destroys private keys on behalf of signature devices.
+type KeyProvider interface {
+	// Generate creates a new key pair for the algorithm and returns its handle. keySize is the
+	// size of the RSA modulus or of the ECC curve in bits, 0 selects the default of the algorithm.
+	Generate(algorithm string, keySize int) (handle string, err error)
+	// Import stores an existing private key of the algorithm and returns its handle. The key may be
+	// in any encoding crypt.DERMarshaler decodes, so keys of earlier versions can be taken over.
+	Import(algorithm string, privateKey []byte) (handle string, err error)
+	// PublicKey returns the encoded public key of a key pair, as stored on SignatureDevice.
+	PublicKey(handle string) ([]byte, error)
+	// Sign signs data with the private key of a key pair, using the named signature scheme
+	// (the mechanism in PKCS#11 terms), like RSA_PSS_SHA256.
+	Sign(handle string, scheme string, data []byte) ([]byte, error)
+	// Signer returns a crypto.Signer for a key pair, for APIs like crypto/x509 that hash
+	// themselves and pick padding with the options. Its private key stays in the provider.
+	Signer(handle string) (crypto.Signer, error)
+	// Destroy irrevocably deletes a key pair.
+	Destroy(handle string) error
+}
@@ -0,0 +1,354 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+)
+
+// SoftToken is a KeyProvider that keeps keys in a local file, in the way an HSM keeps them in a slot.
+// If it has a KeyWrapper, private keys are encrypted at rest with the handle as associated data.
+// Every change rewrites the file atomically. Without a path the token only lives in memory.
+type SoftToken struct {
+	path    string
+	wrapper *crypt.KeyWrapper
+	objects map[string]tokenObject
+	mutex   sync.RWMutex
+}
+
+// tokenObject is a key pair stored in the token.
+type tokenObject struct {
+	Algorithm  string `json:"algorithm"`
+	PublicKey  []byte `json:"public_key"`
+	PrivateKey []byte `json:"private_key"` // wrapped if the token has a KeyWrapper
+}
+
+type tokenFile struct {
+	Objects map[string]tokenObject `json:"objects"`
+}
+
+// NewSoftToken opens the token file at path, creating it on the first write.
+// An empty path creates a token that only lives in memory. wrapper may be nil to store keys in plain,
+// but not if the file holds wrapped keys already: that is ErrKEKRequired.
+func NewSoftToken(path string, wrapper *crypt.KeyWrapper) (*SoftToken, error) {
+	t := &SoftToken{
+		path:    path,
+		wrapper: wrapper,
+		objects: make(map[string]tokenObject),
+	}
+	if path == "" {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading key token: %w", err)
+	}
+
+	var file tokenFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("decoding key token: %w", err)
+	}
+	if file.Objects != nil {
+		t.objects = file.Objects
+	}
+	if err := t.checkUnwrappable(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// checkUnwrappable fails with ErrKEKRequired if the token holds wrapped keys but has no KeyWrapper,
+// which would take them for plain keys. The mutex must be held or the token not yet shared.
+func (t *SoftToken) checkUnwrappable() error {
+	if t.wrapper != nil {
+		return nil
+	}
+	for handle, object := range t.objects {
+		if crypt.IsWrappedKey(object.PrivateKey) {
+			return fmt.Errorf("%w: key %s", ErrKEKRequired, handle)
+		}
+	}
+	return nil
+}
+
+func (t *SoftToken) Generate(algorithm string, keySize int) (string, error) {
+	publicKey, privateKey, err := generateKeyPair(algorithm, keySize)
+	if err != nil {
+		return "", err
+	}
+	return t.add(algorithm, publicKey, privateKey)
+}
+
+func (t *SoftToken) Import(algorithm string, privateKey []byte) (string, error) {
+	if _, err := lookupAlgorithm(algorithm); err != nil {
+		return "", err
+	}
+	keyPair, err := crypt.DERMarshaler{}.Decode(privateKey)
+	if err != nil {
+		return "", err
+	}
+	publicKey, privateKey, err := crypt.DERMarshaler{}.Encode(*keyPair)
+	if err != nil {
+		return "", err
+	}
+	return t.add(algorithm, publicKey, privateKey)
+}
+
+// add stores a key pair in the encoding of the token under a new handle.
+func (t *SoftToken) add(algorithm string, publicKey []byte, privateKey []byte) (string, error) {
+	handle, err := newHandle()
+	if err != nil {
+		return "", err
+	}
+	if t.wrapper != nil {
+		if privateKey, err = t.wrapper.Wrap(handle, privateKey); err != nil {
+			return "", err
+		}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.objects[handle] = tokenObject{Algorithm: algorithm, PublicKey: publicKey, PrivateKey: privateKey}
+	if err := t.save(); err != nil {
+		delete(t.objects, handle)
+		return "", err
+	}
+
+	return handle, nil
+}
+
+func (t *SoftToken) PublicKey(handle string) ([]byte, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	object, exists := t.objects[handle]
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	return object.PublicKey, nil
+}
+
+func (t *SoftToken) Sign(handle string, scheme string, data []byte) ([]byte, error) {
+	object, privateKey, err := t.privateKey(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	signatureScheme, err := crypt.LookupScheme(scheme)
+	if err != nil || signatureScheme.Algorithm != object.Algorithm {
+		return nil, fmt.Errorf("%w: %s for %s key", ErrUnsupportedScheme, scheme, object.Algorithm)
+	}
+
+	signer, err := crypt.NewSigner(signatureScheme, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(data)
+}
+
+func (t *SoftToken) Signer(handle string) (crypto.Signer, error) {
+	t.mutex.RLock()
+	object, exists := t.objects[handle]
+	t.mutex.RUnlock()
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	publicKey, err := crypt.DERMarshaler{}.DecodePublicKey(object.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenSigner{token: t, handle: handle, publicKey: publicKey}, nil
+}
+
+// privateKey returns a key pair with its unwrapped private key.
+func (t *SoftToken) privateKey(handle string) (tokenObject, []byte, error) {
+	t.mutex.RLock()
+	object, exists := t.objects[handle]
+	t.mutex.RUnlock()
+	if !exists {
+		return tokenObject{}, nil, ErrKeyNotFound
+	}
+
+	privateKey := object.PrivateKey
+	if t.wrapper != nil {
+		var err error
+		if privateKey, err = t.wrapper.Unwrap(handle, privateKey); err != nil {
+			return tokenObject{}, nil, err
+		}
+	}
+	return object, privateKey, nil
+}
+
+// tokenSigner is a crypto.Signer that unwraps the private key from the token for every signature.
+type tokenSigner struct {
+	token     *SoftToken
+	handle    string
+	publicKey crypto.PublicKey
+}
+
+func (s *tokenSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *tokenSigner) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	_, privateKey, err := s.token.privateKey(s.handle)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPair, err := crypt.DERMarshaler{}.Decode(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return keyPair.Private.Sign(random, digest, opts)
+}
+
+func (t *SoftToken) Destroy(handle string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	object, exists := t.objects[handle]
+	if !exists {
+		return ErrKeyNotFound
+	}
+
+	delete(t.objects, handle)
+	if err := t.save(); err != nil {
+		t.objects[handle] = object
+		return err
+	}
+	return nil
+}
+
+// Rewrap re-encrypts all private keys under newWrapper and switches the token to it.
+// Plain keys of a token without KeyWrapper are encrypted for the first time, wrapped keys without
+// the KeyWrapper they were wrapped with are ErrKEKRequired.
+// The token file is replaced in one step, so either all keys are rewrapped or none.
+func (t *SoftToken) Rewrap(newWrapper *crypt.KeyWrapper) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err := t.checkUnwrappable(); err != nil {
+		return 0, err
+	}
+
+	rewrapped := make(map[string]tokenObject, len(t.objects))
+	for handle, object := range t.objects {
+		privateKey := object.PrivateKey
+		if t.wrapper != nil {
+			var err error
+			if privateKey, err = t.wrapper.Unwrap(handle, privateKey); err != nil {
+				return 0, fmt.Errorf("unwrapping key %s: %w", handle, err)
+			}
+		}
+
+		var err error
+		if object.PrivateKey, err = newWrapper.Wrap(handle, privateKey); err != nil {
+			return 0, err
+		}
+		rewrapped[handle] = object
+	}
+
+	previous := t.objects
+	t.objects = rewrapped
+	if err := t.save(); err != nil {
+		t.objects = previous
+		return 0, err
+	}
+	t.wrapper = newWrapper
+
+	return len(rewrapped), nil
+}
+
+// save atomically replaces the token file, the mutex must be held.
+func (t *SoftToken) save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(tokenFile{Objects: t.objects})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("writing key token: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing key token: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing key token: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing key token: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), t.path); err != nil {
+		return fmt.Errorf("writing key token: %w", err)
+	}
+	// The rename is only durable once the directory entry is.
+	if err := syncDir(filepath.Dir(t.path)); err != nil {
+		return fmt.Errorf("writing key token: %w", err)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func newHandle() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// generateKeyPair creates a key pair with the registered algorithm.
+// A keySize of 0 selects the algorithm's default.
+func generateKeyPair(algorithm string, keySize int) (publicKey []byte, privateKey []byte, err error) {
+	alg, err := lookupAlgorithm(algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keySize == 0 {
+		keySize = alg.DefaultKeySize
+	}
+	return alg.GenerateKey(keySize)
+}
+
+func lookupAlgorithm(name string) (crypt.Algorithm, error) {
+	alg, err := crypt.LookupAlgorithm(name)
+	if err != nil {
+		return crypt.Algorithm{}, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, name)
+	}
+	return alg, nil
+}
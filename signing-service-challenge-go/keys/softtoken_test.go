@@ -0,0 +1,163 @@
+package keys_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/keys"
+)
+
+const eccScheme = "ECDSA_P384_SHA256"
+
+func newKeyWrapper(t *testing.T, seed byte) *crypt.KeyWrapper {
+	t.Helper()
+	kek := make([]byte, crypt.KEKSize)
+	kek[0] = seed
+	wrapper, err := crypt.NewKeyWrapper(kek)
+	require.NoError(t, err)
+	return wrapper
+}
+
+// assertSigns checks that the key signs data which verifies with its public key.
+func assertSigns(t *testing.T, token keys.KeyProvider, handle string, algorithm string) {
+	t.Helper()
+	alg, err := crypt.LookupAlgorithm(algorithm)
+	require.NoError(t, err)
+	scheme, err := crypt.LookupScheme(alg.DefaultScheme(alg.DefaultKeySize))
+	require.NoError(t, err)
+
+	publicKey, err := token.PublicKey(handle)
+	require.NoError(t, err)
+	signature, err := token.Sign(handle, scheme.Name, []byte("data"))
+	require.NoError(t, err)
+
+	verifier, err := crypt.NewVerifier(scheme, publicKey)
+	require.NoError(t, err)
+	assert.NoError(t, verifier.Verify([]byte("data"), signature))
+}
+
+func TestSoftToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	token, err := keys.NewSoftToken(path, newKeyWrapper(t, 1))
+	require.NoError(t, err)
+
+	handles := make(map[string]string)
+	for _, algorithm := range []string{domain.AlgorithmECC, domain.AlgorithmRSA} {
+		handle, err := token.Generate(algorithm, 0)
+		require.NoError(t, err)
+		assertSigns(t, token, handle, algorithm)
+		handles[algorithm] = handle
+	}
+
+	_, err = token.Generate("DSA", 0)
+	assert.ErrorIs(t, err, keys.ErrUnsupportedAlgorithm)
+	_, err = token.Sign(handles[domain.AlgorithmECC], "RSA_PSS_SHA256", []byte("data"))
+	assert.ErrorIs(t, err, keys.ErrUnsupportedScheme, "scheme must match the key")
+
+	t.Run("Keys survive a reopen", func(t *testing.T) {
+		reopened, err := keys.NewSoftToken(path, newKeyWrapper(t, 1))
+		require.NoError(t, err)
+		for algorithm, handle := range handles {
+			assertSigns(t, reopened, handle, algorithm)
+		}
+	})
+
+	t.Run("Wrong KEK cannot sign", func(t *testing.T) {
+		reopened, err := keys.NewSoftToken(path, newKeyWrapper(t, 2))
+		require.NoError(t, err)
+		_, err = reopened.Sign(handles[domain.AlgorithmECC], eccScheme, []byte("data"))
+		assert.ErrorIs(t, err, crypt.ErrWrongKEK)
+	})
+
+	t.Run("Signer", func(t *testing.T) {
+		signer, err := token.Signer(handles[domain.AlgorithmRSA])
+		require.NoError(t, err)
+		publicKey, ok := signer.Public().(*rsa.PublicKey)
+		require.True(t, ok, "expected an RSA public key, got %T", signer.Public())
+
+		digest := sha256.Sum256([]byte("data"))
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		signature, err := signer.Sign(rand.Reader, digest[:], opts)
+		require.NoError(t, err)
+		assert.NoError(t, rsa.VerifyPSS(publicKey, crypto.SHA256, digest[:], signature, opts))
+
+		_, err = token.Signer("unknown")
+		assert.ErrorIs(t, err, keys.ErrKeyNotFound)
+	})
+
+	t.Run("Destroy", func(t *testing.T) {
+		handle := handles[domain.AlgorithmECC]
+		require.NoError(t, token.Destroy(handle))
+		_, err := token.Sign(handle, eccScheme, []byte("data"))
+		assert.ErrorIs(t, err, keys.ErrKeyNotFound)
+		assert.ErrorIs(t, token.Destroy(handle), keys.ErrKeyNotFound)
+
+		reopened, err := keys.NewSoftToken(path, newKeyWrapper(t, 1))
+		require.NoError(t, err)
+		_, err = reopened.PublicKey(handle)
+		assert.ErrorIs(t, err, keys.ErrKeyNotFound, "destroyed key must not come back")
+	})
+}
+
+func TestSoftTokenRewrap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	token, err := keys.NewSoftToken(path, nil)
+	require.NoError(t, err)
+	handle, err := token.Generate(domain.AlgorithmECC, 0)
+	require.NoError(t, err)
+
+	// Plain keys are wrapped for the first time.
+	rewrapped, err := token.Rewrap(newKeyWrapper(t, 1))
+	require.NoError(t, err)
+	assert.Equal(t, 1, rewrapped)
+	assertSigns(t, token, handle, domain.AlgorithmECC)
+
+	// Wrapped keys are rotated to the new KEK.
+	token, err = keys.NewSoftToken(path, newKeyWrapper(t, 1))
+	require.NoError(t, err)
+	assertSigns(t, token, handle, domain.AlgorithmECC)
+	_, err = token.Rewrap(newKeyWrapper(t, 2))
+	require.NoError(t, err)
+
+	token, err = keys.NewSoftToken(path, newKeyWrapper(t, 2))
+	require.NoError(t, err)
+	assertSigns(t, token, handle, domain.AlgorithmECC)
+
+	token, err = keys.NewSoftToken(path, newKeyWrapper(t, 1))
+	require.NoError(t, err)
+	_, err = token.Sign(handle, eccScheme, []byte("data"))
+	assert.ErrorIs(t, err, crypt.ErrWrongKEK, "old KEK must no longer work")
+
+	// Without the current KEK, wrapped keys must not be taken for plain ones and wrapped twice.
+	_, err = keys.NewSoftToken(path, nil)
+	assert.ErrorIs(t, err, keys.ErrKEKRequired)
+	token, err = keys.NewSoftToken(path, newKeyWrapper(t, 2))
+	require.NoError(t, err)
+	assertSigns(t, token, handle, domain.AlgorithmECC)
+}
+
+func TestSoftTokenImport(t *testing.T) {
+	token, err := keys.NewSoftToken(filepath.Join(t.TempDir(), "keys.json"), newKeyWrapper(t, 1))
+	require.NoError(t, err)
+
+	// Keys of earlier versions were stored as PKCS#1 for RSA.
+	rsaKey, err := (&crypt.RSAGenerator{}).Generate()
+	require.NoError(t, err)
+	handle, err := token.Import(domain.AlgorithmRSA, x509.MarshalPKCS1PrivateKey(rsaKey.Private))
+	require.NoError(t, err)
+	assertSigns(t, token, handle, domain.AlgorithmRSA)
+
+	_, err = token.Import(domain.AlgorithmRSA, []byte("not a key"))
+	assert.ErrorIs(t, err, crypt.ErrMalformedKey)
+	_, err = token.Import("DSA", x509.MarshalPKCS1PrivateKey(rsaKey.Private))
+	assert.ErrorIs(t, err, keys.ErrUnsupportedAlgorithm)
+}
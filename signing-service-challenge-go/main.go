@@ -1,22 +1,272 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/api"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/keys"
 	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
 )
 
 const (
 	ListenAddress = ":8081"
-	// TODO: add further configuration parameters here ...
+
+	// Configuration is read from these environment variables.
+	EnvStore            = "SIGNING_STORE"                // "memory" (default), "file" or "sqlite"
+	EnvDataDir          = "SIGNING_DATA_DIR"             // directory of the file store and the SQLite database
+	EnvSnapshotInterval = "SIGNING_SNAPSHOT_INTERVAL"    // number of changes between snapshots of the file store
+	EnvMinRSAKeySize    = "SIGNING_MIN_RSA_KEY_SIZE"     // smallest RSA key new devices may use, in bits
+	EnvMinECCKeySize    = "SIGNING_MIN_ECC_KEY_SIZE"     // smallest ECC curve new devices may use, in bits
+	EnvKeyToken         = "SIGNING_KEY_TOKEN"            // file of the software key token, defaults to keys.json in the data directory
+	EnvKEK              = "SIGNING_KEK"                  // base64 encoded key-encryption key for private keys at rest
+	EnvKEKFile          = "SIGNING_KEK_FILE"             // file containing the base64 encoded key-encryption key
+	EnvAllowPlaintext   = "SIGNING_ALLOW_PLAINTEXT_KEYS" // "1" to store private keys unencrypted if no KEK is set
+	EnvNewKEK           = "SIGNING_NEW_KEK"              // key-encryption key to rotate to, see rotateKEK
+	EnvNewKEKFile       = "SIGNING_NEW_KEK_FILE"
+
+	EnvIdempotencyRetention = "SIGNING_IDEMPOTENCY_RETENTION" // how long signing requests can be retried, like "24h"
+	EnvMaxBatchSize         = "SIGNING_MAX_BATCH_SIZE"        // most transactions a batch signing request may contain, also scales its body limit, see api.MaxBatchItemSize
+
+	DefaultDataDir      = "data"
+	DefaultKeyTokenFile = "keys.json"
 )
 
 func main() {
-	store := persistence.NewInMemoryDeviceStore()
-	server := api.NewServer(ListenAddress, store)
+	if len(os.Args) > 1 && os.Args[1] == "rotate-kek" {
+		if err := rotateKEK(); err != nil {
+			log.Fatal("Could not rotate key-encryption key: ", err)
+		}
+		return
+	}
+
+	store, err := openStore()
+	if err != nil {
+		log.Fatal("Could not open device store: ", err)
+	}
+
+	wrapper, err := loadTokenKeyWrapper(keyTokenPath())
+	if err != nil {
+		log.Fatal("Could not load key-encryption key: ", err)
+	}
+	token, err := keys.NewSoftToken(keyTokenPath(), wrapper)
+	if err != nil {
+		log.Fatal("Could not open key token: ", err)
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	devices := service.NewDeviceService(store, token, config)
+	imported, err := devices.ImportLegacyKeys(wrapper)
+	if err != nil {
+		log.Fatal("Could not import private keys into the key token: ", err)
+	}
+	if imported > 0 {
+		log.Printf("Imported the private keys of %d devices into the key token", imported)
+	}
+	// Decommissioned devices cannot sign anymore, so keys left behind do not keep the server from starting.
+	destroyed, err := devices.DestroyDecommissionedKeys()
+	if err != nil {
+		log.Printf("Could not destroy the private keys of decommissioned devices: %v", err)
+	}
+	if destroyed > 0 {
+		log.Printf("Destroyed the private keys of %d decommissioned devices", destroyed)
+	}
+
+	server := api.NewServer(ListenAddress, devices)
 
 	if err := server.Run(); err != nil {
 		log.Fatal("Could not start server on ", ListenAddress)
 	}
 }
+
+// openStore creates the device store selected by the environment.
+func openStore() (persistence.DeviceStore, error) {
+	switch backend := os.Getenv(EnvStore); backend {
+	case "", "memory":
+		return persistence.NewInMemoryDeviceStore(), nil
+
+	case "file":
+		snapshotInterval := 0
+		if raw := os.Getenv(EnvSnapshotInterval); raw != "" {
+			var err error
+			snapshotInterval, err = strconv.Atoi(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", EnvSnapshotInterval, err)
+			}
+		}
+		return persistence.NewFileDeviceStore(getEnv(EnvDataDir, DefaultDataDir), snapshotInterval)
+
+	case "sqlite":
+		dataDir := getEnv(EnvDataDir, DefaultDataDir)
+		if err := os.MkdirAll(dataDir, 0o700); err != nil {
+			return nil, fmt.Errorf("creating data directory: %w", err)
+		}
+		return persistence.NewSQLiteDeviceStore(filepath.Join(dataDir, "devices.db"))
+
+	default:
+		return nil, fmt.Errorf("unsupported %s %q", EnvStore, backend)
+	}
+}
+
+// loadConfig applies the settings from the environment to the default configuration.
+func loadConfig() (service.Config, error) {
+	config := service.DefaultConfig()
+
+	policy, err := loadKeyPolicy()
+	if err != nil {
+		return service.Config{}, fmt.Errorf("invalid key policy: %w", err)
+	}
+	config.KeyPolicy = policy
+
+	if raw := os.Getenv(EnvIdempotencyRetention); raw != "" {
+		retention, err := time.ParseDuration(raw)
+		if err != nil || retention <= 0 {
+			return service.Config{}, fmt.Errorf("invalid %s: must be a positive duration like 24h", EnvIdempotencyRetention)
+		}
+		config.IdempotencyRetention = retention
+	}
+
+	if raw := os.Getenv(EnvMaxBatchSize); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < 1 {
+			return service.Config{}, fmt.Errorf("invalid %s: must be a positive number", EnvMaxBatchSize)
+		}
+		config.MaxBatchSize = size
+	}
+
+	return config, nil
+}
+
+// loadKeyPolicy applies the minimum key sizes from the environment to the default policy.
+func loadKeyPolicy() (service.KeyPolicy, error) {
+	policy := service.DefaultKeyPolicy()
+	for env, algorithm := range map[string]string{
+		EnvMinRSAKeySize: domain.AlgorithmRSA,
+		EnvMinECCKeySize: domain.AlgorithmECC,
+	} {
+		if raw := os.Getenv(env); raw != "" {
+			size, err := strconv.Atoi(raw)
+			if err != nil {
+				return service.KeyPolicy{}, fmt.Errorf("invalid %s: %w", env, err)
+			}
+			policy.MinKeySizes[algorithm] = size
+		}
+	}
+	return policy, nil
+}
+
+// keyTokenPath returns the file of the key token. Keys of the in-memory store are kept in memory too,
+// as they would be useless without their devices after a restart.
+func keyTokenPath() string {
+	if path := os.Getenv(EnvKeyToken); path != "" {
+		return path
+	}
+	if backend := os.Getenv(EnvStore); backend == "" || backend == "memory" {
+		return ""
+	}
+	return filepath.Join(getEnv(EnvDataDir, DefaultDataDir), DefaultKeyTokenFile)
+}
+
+// rotateKEK re-wraps all private keys in the key token, which were wrapped with the current
+// key-encryption key, under the new one. Keys still stored on devices are imported into the
+// token first, as they could not be unwrapped with the new key any more. The server must not
+// run at the same time. Afterwards the new key has to be configured as the current one.
+func rotateKEK() error {
+	oldWrapper, err := loadKeyWrapper(EnvKEK, EnvKEKFile)
+	if err != nil {
+		return err
+	}
+	newWrapper, err := loadKeyWrapper(EnvNewKEK, EnvNewKEKFile)
+	if err != nil {
+		return err
+	}
+	if newWrapper == nil {
+		return fmt.Errorf("%s or %s is required", EnvNewKEK, EnvNewKEKFile)
+	}
+
+	path := keyTokenPath()
+	if path == "" {
+		return fmt.Errorf("%s is required for the in-memory store", EnvKeyToken)
+	}
+	// Without the current KEK, the wrapped keys would be taken for plain keys and wrapped twice.
+	token, err := keys.NewSoftToken(path, oldWrapper)
+	if errors.Is(err, keys.ErrKEKRequired) {
+		return fmt.Errorf("%w: set %s or %s to the current key-encryption key", err, EnvKEK, EnvKEKFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	if _, err := service.NewDeviceService(store, token, service.DefaultConfig()).ImportLegacyKeys(oldWrapper); err != nil {
+		return err
+	}
+
+	rewrapped, err := token.Rewrap(newWrapper)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rewrapped %d private keys", rewrapped)
+	return nil
+}
+
+// loadTokenKeyWrapper loads the key-encryption key of the key token at path. Without one, private
+// keys would be written to disk in plain, which has to be allowed explicitly with EnvAllowPlaintext.
+// A token that only lives in memory needs no key.
+func loadTokenKeyWrapper(path string) (*crypt.KeyWrapper, error) {
+	wrapper, err := loadKeyWrapper(EnvKEK, EnvKEKFile)
+	if err != nil || wrapper != nil || path == "" {
+		return wrapper, err
+	}
+
+	if os.Getenv(EnvAllowPlaintext) != "1" {
+		return nil, fmt.Errorf("%s or %s is required to encrypt private keys at rest, set %s=1 to store them unencrypted",
+			EnvKEK, EnvKEKFile, EnvAllowPlaintext)
+	}
+	log.Printf("WARNING: no key-encryption key is configured, private keys are stored unencrypted in %s", path)
+	return nil, nil
+}
+
+// loadKeyWrapper reads a key-encryption key from the environment variable or the file it names.
+// It returns nil if neither is set.
+func loadKeyWrapper(envKey string, envFile string) (*crypt.KeyWrapper, error) {
+	encoded := os.Getenv(envKey)
+	if path := os.Getenv(envFile); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(content)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+
+	kek, err := crypt.ParseKEK(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.NewKeyWrapper(kek)
+}
+
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,359 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	DefaultSnapshotInterval = 1000
+)
+
+// FileDeviceStore is a DeviceStore that survives restarts. It keeps the devices in memory
+// and appends every change to a write-ahead log on disk, which is fsynced before the change
+// is applied and acknowledged. After every snapshotInterval changes the whole state is copied
+// and written to a snapshot in the background, then the log records it contains are removed.
+//
+// Each log line holds a CRC32 checksum and a JSON encoded record. On startup the snapshot is
+// loaded and the log is replayed on top of it. A torn record at the end of the log (the
+// process crashed while writing it) was never acknowledged and is cut off.
+type FileDeviceStore struct {
+	*InMemoryDeviceStore
+	dir              string
+	wal              *os.File
+	walSize          int64  // offset after the last complete record
+	seq              uint64 // sequence number of the last record written
+	snapshotInterval int
+	sinceSnapshot    int
+	snapshotting     bool           // a snapshot is being written
+	snapshots        sync.WaitGroup // the snapshot being written
+	err              error          // set if the log could not be repaired after a failed write
+}
+
+type walRecord struct {
+	Seq    uint64 `json:"seq"`
+	Change change `json:"change"`
+}
+
+type snapshot struct {
+	Seq             uint64                                      `json:"seq"` // last record contained in the snapshot
+	Devices         []domain.SignatureDevice                    `json:"devices"`
+	Signatures      map[string][]domain.Signature               `json:"signatures"`
+	IdempotencyKeys map[string]map[string]domain.IdempotencyKey `json:"idempotency_keys,omitempty"`
+}
+
+// NewFileDeviceStore opens the store in dir, creating it if needed, and recovers its state.
+// A snapshotInterval of 0 or less uses DefaultSnapshotInterval.
+func NewFileDeviceStore(dir string, snapshotInterval int) (*FileDeviceStore, error) {
+	if snapshotInterval <= 0 {
+		snapshotInterval = DefaultSnapshotInterval
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating data directory: %w", err)
+	}
+
+	s := &FileDeviceStore{
+		InMemoryDeviceStore: NewInMemoryDeviceStore(),
+		dir:                 dir,
+		snapshotInterval:    snapshotInterval,
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening write-ahead log: %w", err)
+	}
+	s.wal = wal
+	if err := s.replay(); err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	s.InMemoryDeviceStore.persist = s.append
+	return s, nil
+}
+
+// Close waits for a snapshot being written and closes the write-ahead log.
+// The store must not be used afterwards.
+func (s *FileDeviceStore) Close() error {
+	s.snapshots.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.wal.Close()
+}
+
+func (s *FileDeviceStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+
+	for _, device := range snap.Devices {
+		s.devices[device.ID] = device
+	}
+	for id, signatures := range snap.Signatures {
+		s.signatures[id] = signatures
+	}
+	for id, keys := range snap.IdempotencyKeys {
+		s.idempotencyKeys[id] = keys
+	}
+	s.seq = snap.Seq
+	return nil
+}
+
+// replay applies all log records newer than the snapshot and cuts off a torn last record.
+func (s *FileDeviceStore) replay() error {
+	reader := bufio.NewReader(s.wal)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break // an incomplete last line is a torn write
+		}
+		if err != nil {
+			return fmt.Errorf("reading write-ahead log: %w", err)
+		}
+
+		record, decodeErr := decodeRecord(line)
+		if decodeErr != nil {
+			if _, err := reader.Peek(1); errors.Is(err, io.EOF) {
+				break // the last record is torn
+			}
+			return fmt.Errorf("write-ahead log is corrupt at offset %d: %w", offset, decodeErr)
+		}
+
+		// Records up to the snapshot are left over if we crashed before truncating the log.
+		if record.Seq > s.seq {
+			s.apply(record.Change)
+			s.seq = record.Seq
+			s.sinceSnapshot++
+		}
+		offset += int64(len(line))
+	}
+
+	if err := s.wal.Truncate(offset); err != nil {
+		return fmt.Errorf("truncating write-ahead log: %w", err)
+	}
+	s.walSize = offset
+	return nil
+}
+
+// append writes a change to the log and fsyncs it. It is called with the mutex held.
+func (s *FileDeviceStore) append(c change) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	// All previous changes have been applied by now, so this is a consistent state to snapshot.
+	if s.sinceSnapshot >= s.snapshotInterval && !s.snapshotting {
+		s.startSnapshot()
+	}
+
+	line, err := encodeRecord(walRecord{Seq: s.seq + 1, Change: c})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.wal.Write(line); err != nil {
+		return s.rollback(err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		return s.rollback(err)
+	}
+	s.walSize += int64(len(line))
+	s.seq++
+	s.sinceSnapshot++
+	return nil
+}
+
+// rollback removes a partially written record, so the log stays readable.
+func (s *FileDeviceStore) rollback(cause error) error {
+	if err := s.wal.Truncate(s.walSize); err != nil {
+		s.err = fmt.Errorf("write-ahead log is unusable: %w", err)
+	}
+	return fmt.Errorf("writing write-ahead log: %w", cause)
+}
+
+// startSnapshot copies the current state and writes it to the snapshot in the background, so
+// that the mutex is not held while it is encoded and synced. It is called with the mutex held.
+func (s *FileDeviceStore) startSnapshot() {
+	snap := snapshot{
+		Seq:             s.seq,
+		Devices:         make([]domain.SignatureDevice, 0, len(s.devices)),
+		Signatures:      make(map[string][]domain.Signature, len(s.signatures)),
+		IdempotencyKeys: make(map[string]map[string]domain.IdempotencyKey, len(s.idempotencyKeys)),
+	}
+	for _, device := range s.devices {
+		snap.Devices = append(snap.Devices, device)
+	}
+	// Signatures are only appended, so the copy does not see later ones. Idempotency keys are
+	// changed in place and need a copy of their own.
+	for id, signatures := range s.signatures {
+		snap.Signatures[id] = signatures
+	}
+	for id, keys := range s.idempotencyKeys {
+		snap.IdempotencyKeys[id] = maps.Clone(keys)
+	}
+
+	s.snapshotting = true
+	s.sinceSnapshot = 0
+	walOffset := s.walSize
+	s.snapshots.Add(1)
+	go func() {
+		defer s.snapshots.Done()
+
+		// A failed snapshot is not fatal, the log still has everything and it is retried later.
+		err := writeSnapshot(s.dir, snap)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.snapshotting = false
+		if err == nil {
+			err = s.dropLogPrefix(walOffset)
+		}
+		if err != nil {
+			log.Printf("Could not snapshot the device store in %s: %v", s.dir, err)
+			s.sinceSnapshot = s.snapshotInterval
+		}
+	}()
+}
+
+// writeSnapshot atomically replaces the snapshot in dir.
+func writeSnapshot(dir string, snap snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, snapshotFileName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// dropLogPrefix removes the records before offset from the log, once they are contained in the
+// snapshot. Records up to the snapshot are skipped on replay, so a crash meanwhile is harmless.
+// It is called with the mutex held.
+func (s *FileDeviceStore) dropLogPrefix(offset int64) error {
+	if s.err != nil {
+		return s.err
+	}
+	if offset == s.walSize {
+		if err := s.wal.Truncate(0); err != nil {
+			return err
+		}
+		s.walSize = 0
+		return s.wal.Sync()
+	}
+
+	// Records were appended while the snapshot was written, they are moved to a new log.
+	tail := make([]byte, s.walSize-offset)
+	if _, err := s.wal.ReadAt(tail, offset); err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, walFileName)
+	if err := writeFileSync(path+".tmp", tail); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	// From here on, appending to the old log would lose changes.
+	wal, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		s.err = fmt.Errorf("write-ahead log is unusable: %w", err)
+		return s.err
+	}
+	s.wal.Close()
+	s.wal = wal
+	s.walSize = int64(len(tail))
+	if err := syncDir(s.dir); err != nil {
+		s.err = fmt.Errorf("write-ahead log is unusable: %w", err)
+		return s.err
+	}
+	return nil
+}
+
+func encodeRecord(record walRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, "%08x %s\n", crc32.ChecksumIEEE(payload), payload), nil
+}
+
+func decodeRecord(line []byte) (walRecord, error) {
+	var record walRecord
+	checksum, payload, found := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !found {
+		return record, errors.New("missing checksum")
+	}
+
+	var expected uint32
+	if _, err := fmt.Sscanf(string(checksum), "%08x", &expected); err != nil {
+		return record, fmt.Errorf("invalid checksum: %w", err)
+	}
+	if crc32.ChecksumIEEE(payload) != expected {
+		return record, errors.New("checksum mismatch")
+	}
+
+	err := json.Unmarshal(payload, &record)
+	return record, err
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,165 @@
+package persistence_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+// signN simulates n signatures on a device, the way the API increments the counter.
+func signN(t *testing.T, store persistence.DeviceStore, deviceID string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		err := store.InTx(deviceID, func(d *domain.SignatureDevice, tx persistence.Tx) error {
+			tx.AddSignature(domain.Signature{DeviceID: d.ID, Counter: d.SignatureCounter, Signature: "sig"})
+			d.SignatureCounter++
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+func TestFileDeviceStoreRecovery(t *testing.T) {
+	tests := []struct {
+		name             string
+		snapshotInterval int
+	}{
+		{name: "From the log only", snapshotInterval: 1000},
+		{name: "From snapshot and log", snapshotInterval: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := persistence.NewFileDeviceStore(dir, tt.snapshotInterval)
+			require.NoError(t, err)
+			require.NoError(t, store.Create(domain.SignatureDevice{ID: "device-1", KeyHandle: "key"}))
+			signN(t, store, "device-1", 10)
+			require.NoError(t, store.Close())
+
+			reopened, err := persistence.NewFileDeviceStore(dir, tt.snapshotInterval)
+			require.NoError(t, err)
+			defer reopened.Close()
+
+			device, err := reopened.Get("device-1")
+			require.NoError(t, err)
+			assert.Equal(t, uint64(10), device.SignatureCounter)
+			assert.Equal(t, "key", device.KeyHandle)
+
+			signatures, err := reopened.ListSignatures("device-1", persistence.SignatureFilter{})
+			require.NoError(t, err)
+			assert.Len(t, signatures, 10)
+
+			// Writing after recovery continues the counter.
+			signN(t, reopened, "device-1", 1)
+			device, err = reopened.Get("device-1")
+			require.NoError(t, err)
+			assert.Equal(t, uint64(11), device.SignatureCounter)
+		})
+	}
+}
+
+func TestFileDeviceStoreSnapshotWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	store, err := persistence.NewFileDeviceStore(dir, 5)
+	require.NoError(t, err)
+
+	// Snapshots are written in the background, changes made meanwhile must stay in the log.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		deviceID := fmt.Sprintf("device-%d", i)
+		require.NoError(t, store.Create(domain.SignatureDevice{ID: deviceID}))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			signN(t, store, deviceID, 50)
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, store.Close())
+
+	reopened, err := persistence.NewFileDeviceStore(dir, 5)
+	require.NoError(t, err)
+	defer reopened.Close()
+	for i := 0; i < 4; i++ {
+		device, err := reopened.Get(fmt.Sprintf("device-%d", i))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(50), device.SignatureCounter)
+	}
+}
+
+func TestFileDeviceStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := persistence.NewFileDeviceStore(dir, 1000)
+	require.NoError(t, err)
+	require.NoError(t, store.Create(domain.SignatureDevice{ID: "device-1"}))
+	signN(t, store, "device-1", 2)
+	require.NoError(t, store.Close())
+
+	// Simulate a crash in the middle of writing a record.
+	wal, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`1234abcd {"seq":4,"change":{"dev`)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	reopened, err := persistence.NewFileDeviceStore(dir, 1000)
+	require.NoError(t, err)
+	signN(t, reopened, "device-1", 1)
+	require.NoError(t, reopened.Close())
+
+	reopened, err = persistence.NewFileDeviceStore(dir, 1000)
+	require.NoError(t, err)
+	defer reopened.Close()
+	device, err := reopened.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), device.SignatureCounter)
+}
+
+func TestFileDeviceStoreCorruptLog(t *testing.T) {
+	dir := t.TempDir()
+	store, err := persistence.NewFileDeviceStore(dir, 1000)
+	require.NoError(t, err)
+	require.NoError(t, store.Create(domain.SignatureDevice{ID: "device-1"}))
+	signN(t, store, "device-1", 2)
+	require.NoError(t, store.Close())
+
+	path := filepath.Join(dir, "wal.log")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[20] ^= 0xff // flip a byte in the first record
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	_, err = persistence.NewFileDeviceStore(dir, 1000)
+	assert.ErrorContains(t, err, "corrupt")
+}
+
+func TestFileDeviceStoreLegacyPrivateKey(t *testing.T) {
+	dir := t.TempDir()
+
+	// A snapshot written when devices stored their private keys.
+	snapshot := `{"seq":1,"devices":[{"ID":"device-1","Label":"Till","Algorithm":"ECC","PublicKey":"AQI=","PrivateKey":"AwQ=","SignatureCounter":0,"LastSignature":""}],"signatures":{}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "snapshot.json"), []byte(snapshot), 0o600))
+
+	// Changes and snapshots written afterwards must keep the key until it has been imported.
+	store, err := persistence.NewFileDeviceStore(dir, 1)
+	require.NoError(t, err)
+	signN(t, store, "device-1", 2)
+	require.NoError(t, store.Close())
+
+	reopened, err := persistence.NewFileDeviceStore(dir, 1)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	device, err := reopened.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{3, 4}, device.PrivateKey)
+	assert.Equal(t, uint64(2), device.SignatureCounter)
+}
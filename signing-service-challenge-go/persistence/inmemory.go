@@ -2,35 +2,117 @@ package persistence
 
 import (
 	"errors"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
 )
 
 var (
-	ErrDeviceNotFound = errors.New("device not found")
-	ErrDeviceExists   = errors.New("device already exists")
+	ErrDeviceNotFound         = errors.New("device not found")
+	ErrDeviceExists           = errors.New("device already exists")
+	ErrSignatureNotFound      = errors.New("signature not found")
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
 )
 
 type DeviceStore interface {
+	SignatureStore
+	IdempotencyStore
 	Create(device domain.SignatureDevice) error
 	Get(id string) (domain.SignatureDevice, error)
 	Update(device domain.SignatureDevice) error
-	InTx(deviceID string, fn func(d *domain.SignatureDevice) error) error
+	List(filter ListFilter) ([]domain.SignatureDevice, error)
+	// InTx runs fn on the device and writes the result atomically. fn may run more than once if
+	// the device was changed concurrently, so it must not have effects beyond d and tx.
+	InTx(deviceID string, fn func(d *domain.SignatureDevice, tx Tx) error) error
 }
 
+// SignatureStore gives read access to the signature history of the devices.
+// Signatures are only written through the Tx of DeviceStore.InTx.
+type SignatureStore interface {
+	GetSignature(deviceID string, counter uint64) (domain.Signature, error)
+	ListSignatures(deviceID string, filter SignatureFilter) ([]domain.Signature, error)
+}
+
+// IdempotencyStore gives read access to the idempotency keys of signing requests.
+// Keys are only written through the Tx of DeviceStore.InTx, so reading one in the function
+// passed to InTx is consistent with the device.
+type IdempotencyStore interface {
+	GetIdempotencyKey(deviceID string, key string) (domain.IdempotencyKey, error)
+}
+
+// Tx collects the records that have to be written atomically with the device update in InTx.
+// Nothing is written if the function passed to InTx returns an error.
+type Tx interface {
+	AddSignature(signature domain.Signature)
+	// PutIdempotencyKey stores a key, replacing an expired one of the same name.
+	PutIdempotencyKey(key domain.IdempotencyKey)
+	// ExpireIdempotencyKeys deletes the device's keys created before the time.
+	ExpireIdempotencyKeys(createdBefore time.Time)
+}
+
+// SignatureFilter pages the signatures returned by ListSignatures.
+// Signatures are always returned in ascending order of their counter.
+type SignatureFilter struct {
+	FromCounter uint64 // inclusive
+	Limit       int    // 0 means no limit
+}
+
+// ListFilter narrows down and pages the devices returned by List.
+// Devices are always returned in ascending order of their ID.
+type ListFilter struct {
+	AfterID     string // only devices with an ID greater than this one, used for paging
+	Limit       int    // 0 means no limit
+	Algorithm   string
+	LabelPrefix string
+}
+
+// Matches reports whether the device passes the algorithm and label filters.
+func (f ListFilter) Matches(device domain.SignatureDevice) bool {
+	if f.Algorithm != "" && device.Algorithm != f.Algorithm {
+		return false
+	}
+	return strings.HasPrefix(device.Label, f.LabelPrefix)
+}
+
+// InMemoryDeviceStore keeps devices and signatures in maps.
+//
+// The maps are guarded by mutex, which is only held briefly to read or apply a change.
+// Writes to a device are serialized by a per-device lock instead, so that the potentially
+// slow function passed to InTx does not block other devices.
 type InMemoryDeviceStore struct {
-	devices map[string]domain.SignatureDevice
-	mutex   sync.Mutex // map is not concurrency safe
+	devices         map[string]domain.SignatureDevice
+	signatures      map[string][]domain.Signature               // per device, index equals the counter
+	idempotencyKeys map[string]map[string]domain.IdempotencyKey // per device and key
+	mutex           sync.RWMutex                                // maps are not concurrency safe
+	deviceLocks     deviceLocks
+
+	// persist is called with the mutex held before a change is applied. Durable stores use it
+	// to write the change to disk, the change is discarded if it returns an error.
+	persist func(c change) error
+}
+
+// change is a single committed write: the new state of a device and the records added with it.
+type change struct {
+	Device          domain.SignatureDevice  `json:"device"`
+	Signatures      []domain.Signature      `json:"signatures,omitempty"`
+	IdempotencyKeys []domain.IdempotencyKey `json:"idempotency_keys,omitempty"`
+	ExpireKeys      *time.Time              `json:"expire_keys,omitempty"` // idempotency keys created before are deleted
 }
 
 func NewInMemoryDeviceStore() *InMemoryDeviceStore {
 	return &InMemoryDeviceStore{
-		devices: make(map[string]domain.SignatureDevice),
+		devices:         make(map[string]domain.SignatureDevice),
+		signatures:      make(map[string][]domain.Signature),
+		idempotencyKeys: make(map[string]map[string]domain.IdempotencyKey),
 	}
 }
 
 func (s *InMemoryDeviceStore) Create(device domain.SignatureDevice) error {
+	unlock := s.deviceLocks.lock(device.ID)
+	defer unlock()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -38,25 +120,25 @@ func (s *InMemoryDeviceStore) Create(device domain.SignatureDevice) error {
 		return ErrDeviceExists
 	}
 
-	s.devices[device.ID] = device
-	return nil
+	return s.commit(change{Device: device})
 }
 
 func (s *InMemoryDeviceStore) Update(device domain.SignatureDevice) error {
+	unlock := s.deviceLocks.lock(device.ID)
+	defer unlock()
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	if _, exists := s.devices[device.ID]; !exists {
 		return ErrDeviceNotFound
 	}
-	s.devices[device.ID] = device
 
-	return nil
+	return s.commit(change{Device: device})
 }
 
 func (s *InMemoryDeviceStore) Get(id string) (domain.SignatureDevice, error) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
 	device, exists := s.devices[id]
 	if !exists {
@@ -66,21 +148,160 @@ func (s *InMemoryDeviceStore) Get(id string) (domain.SignatureDevice, error) {
 	return device, nil
 }
 
-// InTx runs a provided function atomically to avoid race conditions
-func (s *InMemoryDeviceStore) InTx(deviceID string, fn func(d *domain.SignatureDevice) error) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+// List returns the devices matching the filter, ordered by ID.
+// Sorting on every call is fine for an in-memory store, a database would use an index.
+func (s *InMemoryDeviceStore) List(filter ListFilter) ([]domain.SignatureDevice, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	devices := make([]domain.SignatureDevice, 0)
+	for id, device := range s.devices {
+		if id > filter.AfterID && filter.Matches(device) {
+			devices = append(devices, device)
+		}
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	if filter.Limit > 0 && len(devices) > filter.Limit {
+		devices = devices[:filter.Limit]
+	}
+
+	return devices, nil
+}
+
+func (s *InMemoryDeviceStore) GetSignature(deviceID string, counter uint64) (domain.Signature, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, exists := s.devices[deviceID]; !exists {
+		return domain.Signature{}, ErrDeviceNotFound
+	}
+
+	signatures := s.signatures[deviceID]
+	if counter >= uint64(len(signatures)) {
+		return domain.Signature{}, ErrSignatureNotFound
+	}
+
+	return signatures[counter], nil
+}
+
+func (s *InMemoryDeviceStore) ListSignatures(deviceID string, filter SignatureFilter) ([]domain.Signature, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 
+	if _, exists := s.devices[deviceID]; !exists {
+		return nil, ErrDeviceNotFound
+	}
+
+	signatures := s.signatures[deviceID]
+	if filter.FromCounter >= uint64(len(signatures)) {
+		return []domain.Signature{}, nil
+	}
+
+	signatures = signatures[filter.FromCounter:]
+	if filter.Limit > 0 && len(signatures) > filter.Limit {
+		signatures = signatures[:filter.Limit]
+	}
+
+	return append([]domain.Signature(nil), signatures...), nil
+}
+
+func (s *InMemoryDeviceStore) GetIdempotencyKey(deviceID string, key string) (domain.IdempotencyKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if _, exists := s.devices[deviceID]; !exists {
+		return domain.IdempotencyKey{}, ErrDeviceNotFound
+	}
+
+	record, exists := s.idempotencyKeys[deviceID][key]
+	if !exists {
+		return domain.IdempotencyKey{}, ErrIdempotencyKeyNotFound
+	}
+	return record, nil
+}
+
+// InTx runs a provided function atomically to avoid race conditions.
+// Only the device's lock is held while fn runs, the store is locked just for the commit.
+func (s *InMemoryDeviceStore) InTx(deviceID string, fn func(d *domain.SignatureDevice, tx Tx) error) error {
+	unlock := s.deviceLocks.lock(deviceID)
+	defer unlock()
+
+	s.mutex.RLock()
 	device, exists := s.devices[deviceID]
+	s.mutex.RUnlock()
 	if !exists {
 		return ErrDeviceNotFound
 	}
 
 	workingCopy := device // To avoid overwriting the original in store in case something breaks
-	if err := fn(&workingCopy); err != nil {
+	tx := &inMemoryTx{}
+	if err := fn(&workingCopy, tx); err != nil {
 		return err
 	}
 
-	s.devices[deviceID] = workingCopy
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.commit(change{
+		Device:          workingCopy,
+		Signatures:      tx.signatures,
+		IdempotencyKeys: tx.idempotencyKeys,
+		ExpireKeys:      tx.expireKeys,
+	})
+}
+
+// commit persists and applies a change, the mutex and the device's lock must be held.
+func (s *InMemoryDeviceStore) commit(c change) error {
+	if s.persist != nil {
+		if err := s.persist(c); err != nil {
+			return err
+		}
+	}
+
+	s.apply(c)
 	return nil
 }
+
+func (s *InMemoryDeviceStore) apply(c change) {
+	s.devices[c.Device.ID] = c.Device
+	if len(c.Signatures) > 0 {
+		s.signatures[c.Device.ID] = append(s.signatures[c.Device.ID], c.Signatures...)
+	}
+
+	keys := s.idempotencyKeys[c.Device.ID]
+	if c.ExpireKeys != nil {
+		for name, key := range keys {
+			if key.CreatedAt.Before(*c.ExpireKeys) {
+				delete(keys, name)
+			}
+		}
+	}
+	if len(c.IdempotencyKeys) > 0 {
+		if keys == nil {
+			keys = make(map[string]domain.IdempotencyKey)
+			s.idempotencyKeys[c.Device.ID] = keys
+		}
+		for _, key := range c.IdempotencyKeys {
+			keys[key.Key] = key
+		}
+	}
+}
+
+// inMemoryTx buffers the records of a transaction until it is committed.
+type inMemoryTx struct {
+	signatures      []domain.Signature
+	idempotencyKeys []domain.IdempotencyKey
+	expireKeys      *time.Time
+}
+
+func (tx *inMemoryTx) AddSignature(signature domain.Signature) {
+	tx.signatures = append(tx.signatures, signature)
+}
+
+func (tx *inMemoryTx) PutIdempotencyKey(key domain.IdempotencyKey) {
+	tx.idempotencyKeys = append(tx.idempotencyKeys, key)
+}
+
+func (tx *inMemoryTx) ExpireIdempotencyKeys(createdBefore time.Time) {
+	tx.expireKeys = &createdBefore
+}
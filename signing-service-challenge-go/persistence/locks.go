@@ -0,0 +1,43 @@
+package persistence
+
+import "sync"
+
+// deviceLocks hands out one mutex per device ID, so that transactions on the same device
+// are serialized while transactions on different devices run in parallel.
+// A mutex is removed again once nobody holds or waits for it.
+type deviceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*deviceLock
+}
+
+type deviceLock struct {
+	sync.Mutex
+	refs int // number of goroutines holding or waiting for the lock
+}
+
+// lock acquires the mutex of a device and returns the function that releases it.
+func (l *deviceLocks) lock(deviceID string) (unlock func()) {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*deviceLock)
+	}
+	lock, exists := l.locks[deviceID]
+	if !exists {
+		lock = &deviceLock{}
+		l.locks[deviceID] = lock
+	}
+	lock.refs++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, deviceID)
+		}
+		l.mutex.Unlock()
+	}
+}
@@ -0,0 +1,18 @@
+CREATE TABLE devices (
+    id                TEXT    NOT NULL PRIMARY KEY,
+    label             TEXT    NOT NULL,
+    algorithm         TEXT    NOT NULL,
+    public_key        BLOB,
+    private_key       BLOB,
+    signature_counter INTEGER NOT NULL DEFAULT 0,
+    last_signature    TEXT    NOT NULL DEFAULT ''
+);
+
+CREATE TABLE signatures (
+    device_id   TEXT    NOT NULL REFERENCES devices (id),
+    counter     INTEGER NOT NULL,
+    signature   TEXT    NOT NULL,
+    signed_data TEXT    NOT NULL,
+    created_at  TEXT    NOT NULL,
+    PRIMARY KEY (device_id, counter)
+);
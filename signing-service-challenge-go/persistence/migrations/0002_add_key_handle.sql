@@ -0,0 +1,4 @@
+-- Private keys are held by the key provider now, devices only reference them by handle.
+-- The private_key column holds the keys of devices created before, until they are imported
+-- into the key provider at startup, see service.ImportLegacyKeys.
+ALTER TABLE devices ADD COLUMN key_handle TEXT NOT NULL DEFAULT '';
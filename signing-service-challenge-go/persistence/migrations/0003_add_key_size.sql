@@ -0,0 +1,2 @@
+-- Devices created before the key size was recorded keep 0.
+ALTER TABLE devices ADD COLUMN key_size INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+-- An empty scheme means the default scheme of the device's algorithm.
+ALTER TABLE devices ADD COLUMN scheme TEXT NOT NULL DEFAULT '';
+ALTER TABLE signatures ADD COLUMN scheme TEXT NOT NULL DEFAULT '';
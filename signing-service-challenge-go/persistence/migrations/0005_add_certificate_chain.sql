@@ -0,0 +1,2 @@
+-- PEM encoded certificate chain of the device key, NULL if none was issued or uploaded.
+ALTER TABLE devices ADD COLUMN certificate_chain BLOB;
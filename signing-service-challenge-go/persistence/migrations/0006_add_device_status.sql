@@ -0,0 +1,2 @@
+-- Devices created before lifecycle states existed are active.
+ALTER TABLE devices ADD COLUMN status TEXT NOT NULL DEFAULT 'ACTIVE';
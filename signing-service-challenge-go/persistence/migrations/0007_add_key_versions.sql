@@ -0,0 +1,5 @@
+-- The key versions of a device are only ever read and written together with the device,
+-- so they are kept as a JSON array. NULL for devices whose keys were never recorded.
+ALTER TABLE devices ADD COLUMN key_versions TEXT;
+-- 0 for signatures created before keys could be rotated.
+ALTER TABLE signatures ADD COLUMN key_version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,9 @@
+-- created_at is in Unix nanoseconds, so expired keys can be found by comparing numbers.
+CREATE TABLE idempotency_keys (
+    device_id    TEXT    NOT NULL REFERENCES devices (id),
+    key          TEXT    NOT NULL,
+    request_hash TEXT    NOT NULL,
+    counter      INTEGER NOT NULL,
+    created_at   INTEGER NOT NULL,
+    PRIMARY KEY (device_id, key)
+);
@@ -0,0 +1,2 @@
+-- 0 for signatures created before the format of the secured data was recorded, which all have version 1.
+ALTER TABLE signatures ADD COLUMN data_format INTEGER NOT NULL DEFAULT 0;
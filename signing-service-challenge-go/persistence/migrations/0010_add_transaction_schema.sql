@@ -0,0 +1,2 @@
+-- Empty for devices whose transactions are not validated against a schema.
+ALTER TABLE devices ADD COLUMN transaction_schema TEXT NOT NULL DEFAULT '';
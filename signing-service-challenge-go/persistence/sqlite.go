@@ -0,0 +1,434 @@
+package persistence
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+const (
+	deviceColumns    = "id, label, algorithm, key_size, public_key, key_handle, scheme, status, signature_counter, last_signature, certificate_chain, key_versions, transaction_schema, private_key"
+	signatureColumns = "device_id, counter, signature, scheme, key_version, data_format, signed_data, created_at"
+)
+
+// SQLiteDeviceStore is a DeviceStore backed by an embedded SQLite database.
+//
+// SQLite has no row locks, a write transaction locks the whole database. So InTx runs fn outside
+// of the database transaction, under a per-device lock that serializes transactions on the same
+// device within the process, while transactions on different devices run fn in parallel. Only
+// checking that the device is unchanged and writing the result happen in a short transaction,
+// which catches changes by another process using the same database. Write transactions start with
+// BEGIN IMMEDIATE and are serialized by writeMutex instead of letting them fail with SQLITE_BUSY.
+// Reads are not blocked by writers thanks to the write-ahead journal.
+type SQLiteDeviceStore struct {
+	db          *sql.DB
+	writeMutex  sync.Mutex
+	deviceLocks deviceLocks
+}
+
+// NewSQLiteDeviceStore opens the database at path, creating it if needed,
+// and applies all pending schema migrations.
+func NewSQLiteDeviceStore(path string) (*SQLiteDeviceStore, error) {
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=synchronous(FULL)&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteDeviceStore{db: db}, nil
+}
+
+// Close closes the database. The store must not be used afterwards.
+func (s *SQLiteDeviceStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies the embedded migrations that have not been applied yet, each in its own transaction.
+// Migration files are named <version>_<description>.sql and applied in order of their version.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER NOT NULL PRIMARY KEY,
+		applied_at TEXT    NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("creating migrations table: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	files, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		name := strings.TrimPrefix(file, "migrations/")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return fmt.Errorf("invalid migration name %q", name)
+		}
+		if version <= current {
+			continue
+		}
+
+		script, err := migrations.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := applyMigration(db, version, string(script)); err != nil {
+			return fmt.Errorf("applying migration %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int, script string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)",
+		version, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDeviceStore) Create(device domain.SignatureDevice) error {
+	unlock := s.deviceLocks.lock(device.ID)
+	defer unlock()
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := getDevice(tx, device.ID); err == nil {
+		return ErrDeviceExists
+	} else if !errors.Is(err, ErrDeviceNotFound) {
+		return err
+	}
+
+	keyVersions, err := encodeKeyVersions(device.KeyVersions)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO devices ("+deviceColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		device.ID, device.Label, device.Algorithm, device.KeySize, device.PublicKey, device.KeyHandle, device.Scheme, device.Status,
+		device.SignatureCounter, device.LastSignature, device.CertificateChain, keyVersions, device.TransactionSchema, device.PrivateKey); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDeviceStore) Update(device domain.SignatureDevice) error {
+	unlock := s.deviceLocks.lock(device.ID)
+	defer unlock()
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateDevice(tx, device); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteDeviceStore) Get(id string) (domain.SignatureDevice, error) {
+	return getDevice(s.db, id)
+}
+
+func (s *SQLiteDeviceStore) List(filter ListFilter) ([]domain.SignatureDevice, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // no limit in SQLite
+	}
+
+	// substr instead of LIKE, because LIKE is case-insensitive and treats % and _ as wildcards.
+	rows, err := s.db.Query("SELECT "+deviceColumns+" FROM devices"+
+		" WHERE id > ? AND (? = '' OR algorithm = ?) AND substr(label, 1, length(?)) = ?"+
+		" ORDER BY id LIMIT ?",
+		filter.AfterID, filter.Algorithm, filter.Algorithm, filter.LabelPrefix, filter.LabelPrefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]domain.SignatureDevice, 0)
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+func (s *SQLiteDeviceStore) GetSignature(deviceID string, counter uint64) (domain.Signature, error) {
+	if _, err := getDevice(s.db, deviceID); err != nil {
+		return domain.Signature{}, err
+	}
+
+	row := s.db.QueryRow("SELECT "+signatureColumns+" FROM signatures"+
+		" WHERE device_id = ? AND counter = ?", deviceID, counter)
+	signature, err := scanSignature(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.Signature{}, ErrSignatureNotFound
+	}
+
+	return signature, err
+}
+
+func (s *SQLiteDeviceStore) ListSignatures(deviceID string, filter SignatureFilter) ([]domain.Signature, error) {
+	if _, err := getDevice(s.db, deviceID); err != nil {
+		return nil, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1 // no limit in SQLite
+	}
+
+	rows, err := s.db.Query("SELECT "+signatureColumns+" FROM signatures"+
+		" WHERE device_id = ? AND counter >= ? ORDER BY counter LIMIT ?", deviceID, filter.FromCounter, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	signatures := make([]domain.Signature, 0)
+	for rows.Next() {
+		signature, err := scanSignature(rows)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, signature)
+	}
+
+	return signatures, rows.Err()
+}
+
+func (s *SQLiteDeviceStore) GetIdempotencyKey(deviceID string, key string) (domain.IdempotencyKey, error) {
+	if _, err := getDevice(s.db, deviceID); err != nil {
+		return domain.IdempotencyKey{}, err
+	}
+
+	record := domain.IdempotencyKey{DeviceID: deviceID, Key: key}
+	var createdAt int64
+	err := s.db.QueryRow("SELECT request_hash, counter, created_at FROM idempotency_keys WHERE device_id = ? AND key = ?",
+		deviceID, key).Scan(&record.RequestHash, &record.Counter, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.IdempotencyKey{}, ErrIdempotencyKeyNotFound
+	}
+	if err != nil {
+		return domain.IdempotencyKey{}, err
+	}
+
+	record.CreatedAt = time.Unix(0, createdAt).UTC()
+	return record, nil
+}
+
+// InTx runs fn on the device and writes its result in a database transaction. All writes to the
+// device in this process hold its lock, so the device read before fn cannot change until the
+// transaction is committed. If another process changed it meanwhile, fn is run again on the new
+// state, so it must not have effects other than on the device and tx. Nothing is written if fn
+// returns an error.
+func (s *SQLiteDeviceStore) InTx(deviceID string, fn func(d *domain.SignatureDevice, tx Tx) error) error {
+	unlock := s.deviceLocks.lock(deviceID)
+	defer unlock()
+
+	for {
+		read, err := getDevice(s.db, deviceID)
+		if err != nil {
+			return err
+		}
+
+		device := read
+		device.KeyVersions = slices.Clone(read.KeyVersions)
+		tx := &inMemoryTx{}
+		if err := fn(&device, tx); err != nil {
+			return err
+		}
+
+		if err := s.commit(read, device, tx); !errors.Is(err, errDeviceChanged) {
+			return err
+		}
+	}
+}
+
+// errDeviceChanged reports that the device was changed since InTx read it.
+var errDeviceChanged = errors.New("device changed concurrently")
+
+// commit writes the result of a transaction on the device, provided the stored device still
+// equals the one read before.
+func (s *SQLiteDeviceStore) commit(read domain.SignatureDevice, device domain.SignatureDevice, tx *inMemoryTx) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	dbTx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer dbTx.Rollback()
+
+	current, err := getDevice(dbTx, device.ID)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(current, read) {
+		return errDeviceChanged
+	}
+
+	if err := updateDevice(dbTx, device); err != nil {
+		return err
+	}
+	for _, signature := range tx.signatures {
+		if _, err := dbTx.Exec("INSERT INTO signatures ("+signatureColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			signature.DeviceID, signature.Counter, signature.Signature, signature.Scheme, signature.KeyVersion, signature.DataFormat, signature.SignedData,
+			signature.CreatedAt.UTC().Format(time.RFC3339Nano)); err != nil {
+			return err
+		}
+	}
+	if tx.expireKeys != nil {
+		if _, err := dbTx.Exec("DELETE FROM idempotency_keys WHERE device_id = ? AND created_at < ?",
+			device.ID, tx.expireKeys.UnixNano()); err != nil {
+			return err
+		}
+	}
+	for _, key := range tx.idempotencyKeys {
+		if _, err := dbTx.Exec("INSERT OR REPLACE INTO idempotency_keys (device_id, key, request_hash, counter, created_at)"+
+			" VALUES (?, ?, ?, ?, ?)", key.DeviceID, key.Key, key.RequestHash, key.Counter, key.CreatedAt.UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	return dbTx.Commit()
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func getDevice(q queryer, id string) (domain.SignatureDevice, error) {
+	device, err := scanDevice(q.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return domain.SignatureDevice{}, ErrDeviceNotFound
+	}
+
+	return device, err
+}
+
+func updateDevice(tx *sql.Tx, device domain.SignatureDevice) error {
+	keyVersions, err := encodeKeyVersions(device.KeyVersions)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec("UPDATE devices SET label = ?, algorithm = ?, key_size = ?, public_key = ?, key_handle = ?, scheme = ?, status = ?,"+
+		" signature_counter = ?, last_signature = ?, certificate_chain = ?, key_versions = ?, transaction_schema = ?, private_key = ? WHERE id = ?",
+		device.Label, device.Algorithm, device.KeySize, device.PublicKey, device.KeyHandle, device.Scheme, device.Status,
+		device.SignatureCounter, device.LastSignature, device.CertificateChain, keyVersions, device.TransactionSchema, device.PrivateKey, device.ID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrDeviceNotFound
+	}
+
+	return nil
+}
+
+func scanDevice(row scanner) (domain.SignatureDevice, error) {
+	var (
+		device      domain.SignatureDevice
+		keyVersions sql.NullString
+	)
+	if err := row.Scan(&device.ID, &device.Label, &device.Algorithm, &device.KeySize, &device.PublicKey, &device.KeyHandle, &device.Scheme, &device.Status,
+		&device.SignatureCounter, &device.LastSignature, &device.CertificateChain, &keyVersions, &device.TransactionSchema, &device.PrivateKey); err != nil {
+		return domain.SignatureDevice{}, err
+	}
+
+	if keyVersions.Valid {
+		if err := json.Unmarshal([]byte(keyVersions.String), &device.KeyVersions); err != nil {
+			return domain.SignatureDevice{}, fmt.Errorf("decoding key versions of device %s: %w", device.ID, err)
+		}
+	}
+	return device, nil
+}
+
+func encodeKeyVersions(keyVersions []domain.KeyVersion) (sql.NullString, error) {
+	if len(keyVersions) == 0 {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(keyVersions)
+	return sql.NullString{String: string(encoded), Valid: true}, err
+}
+
+func scanSignature(row scanner) (domain.Signature, error) {
+	var (
+		signature domain.Signature
+		createdAt string
+	)
+	if err := row.Scan(&signature.DeviceID, &signature.Counter, &signature.Signature, &signature.Scheme, &signature.KeyVersion, &signature.DataFormat, &signature.SignedData, &createdAt); err != nil {
+		return domain.Signature{}, err
+	}
+
+	var err error
+	signature.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	return signature, err
+}
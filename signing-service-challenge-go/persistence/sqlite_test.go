@@ -0,0 +1,112 @@
+package persistence_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+func TestSQLiteDeviceStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.db")
+	store, err := persistence.NewSQLiteDeviceStore(path)
+	require.NoError(t, err)
+	require.NoError(t, store.Create(domain.SignatureDevice{ID: "device-1", Label: "Till", KeyHandle: "key"}))
+	signN(t, store, "device-1", 3)
+	require.NoError(t, store.Close())
+
+	// Opening an up to date database must not apply any migration twice.
+	reopened, err := persistence.NewSQLiteDeviceStore(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	device, err := reopened.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, "Till", device.Label)
+	assert.Equal(t, "key", device.KeyHandle)
+	assert.Equal(t, uint64(3), device.SignatureCounter)
+
+	signature, err := reopened.GetSignature("device-1", 2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), signature.Counter)
+}
+
+func TestSQLiteDeviceStoreUpgrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.db")
+
+	// A database of the first schema version, when devices stored their private keys.
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE schema_migrations (version INTEGER NOT NULL PRIMARY KEY, applied_at TEXT NOT NULL);
+		INSERT INTO schema_migrations VALUES (1, '2024-05-01T12:00:00Z');
+		CREATE TABLE devices (
+			id TEXT NOT NULL PRIMARY KEY, label TEXT NOT NULL, algorithm TEXT NOT NULL, public_key BLOB, private_key BLOB,
+			signature_counter INTEGER NOT NULL DEFAULT 0, last_signature TEXT NOT NULL DEFAULT ''
+		);
+		CREATE TABLE signatures (
+			device_id TEXT NOT NULL REFERENCES devices (id), counter INTEGER NOT NULL, signature TEXT NOT NULL,
+			signed_data TEXT NOT NULL, created_at TEXT NOT NULL, PRIMARY KEY (device_id, counter)
+		);
+		INSERT INTO devices VALUES ('device-1', 'Till', 'ECC', x'0102', x'0304', 0, '');`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	store, err := persistence.NewSQLiteDeviceStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+
+	device, err := store.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{3, 4}, device.PrivateKey)
+	assert.Empty(t, device.KeyHandle)
+
+	// Importing the key into the key provider moves it from the device to the handle.
+	device.KeyHandle, device.PrivateKey = "key", nil
+	require.NoError(t, store.Update(device))
+	device, err = store.Get("device-1")
+	require.NoError(t, err)
+	assert.Empty(t, device.PrivateKey)
+	assert.Equal(t, "key", device.KeyHandle)
+}
+
+func TestSQLiteDeviceStoreConcurrentProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.db")
+
+	// Two stores on the same database share no locks, like two processes.
+	stores := make([]*persistence.SQLiteDeviceStore, 2)
+	for i := range stores {
+		store, err := persistence.NewSQLiteDeviceStore(path)
+		require.NoError(t, err)
+		defer store.Close()
+		stores[i] = store
+	}
+	require.NoError(t, stores[0].Create(domain.SignatureDevice{ID: "device-1"}))
+
+	var wg sync.WaitGroup
+	for _, store := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				err := store.InTx("device-1", func(d *domain.SignatureDevice, tx persistence.Tx) error {
+					tx.AddSignature(domain.Signature{DeviceID: d.ID, Counter: d.SignatureCounter, Signature: "sig"})
+					time.Sleep(time.Millisecond) // the other store changes the device meanwhile
+					d.SignatureCounter++
+					return nil
+				})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	device, err := stores[0].Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(40), device.SignatureCounter)
+}
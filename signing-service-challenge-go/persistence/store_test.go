@@ -0,0 +1,103 @@
+package persistence_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence/storetest"
+)
+
+func TestInMemoryDeviceStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) persistence.DeviceStore {
+		return persistence.NewInMemoryDeviceStore()
+	})
+}
+
+func TestFileDeviceStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) persistence.DeviceStore {
+		// A small interval, so that snapshots are taken while the suite runs.
+		store, err := persistence.NewFileDeviceStore(t.TempDir(), 10)
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestSQLiteDeviceStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) persistence.DeviceStore {
+		store, err := persistence.NewSQLiteDeviceStore(filepath.Join(t.TempDir(), "devices.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+// BenchmarkInTx measures concurrent transactions whose function takes as long as a slow
+// RSA signature. Transactions on different devices must not wait for each other.
+func BenchmarkInTx(b *testing.B) {
+	const (
+		devices  = 16
+		signTime = time.Millisecond
+	)
+
+	stores := []struct {
+		name string
+		open func(b *testing.B) persistence.DeviceStore
+	}{
+		{name: "InMemory", open: func(b *testing.B) persistence.DeviceStore {
+			return persistence.NewInMemoryDeviceStore()
+		}},
+		{name: "File", open: func(b *testing.B) persistence.DeviceStore {
+			store, err := persistence.NewFileDeviceStore(b.TempDir(), 0)
+			require.NoError(b, err)
+			b.Cleanup(func() { store.Close() })
+			return store
+		}},
+		{name: "SQLite", open: func(b *testing.B) persistence.DeviceStore {
+			store, err := persistence.NewSQLiteDeviceStore(filepath.Join(b.TempDir(), "devices.db"))
+			require.NoError(b, err)
+			b.Cleanup(func() { store.Close() })
+			return store
+		}},
+	}
+
+	for _, st := range stores {
+		for _, bb := range []struct {
+			name    string
+			devices int
+		}{
+			{name: "SameDevice", devices: 1},
+			{name: "DifferentDevices", devices: devices},
+		} {
+			b.Run(st.name+"/"+bb.name, func(b *testing.B) {
+				store := st.open(b)
+				for i := 0; i < bb.devices; i++ {
+					require.NoError(b, store.Create(domain.SignatureDevice{ID: fmt.Sprintf("device-%d", i)}))
+				}
+
+				var next atomic.Int64
+				b.SetParallelism(devices)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					deviceID := fmt.Sprintf("device-%d", next.Add(1)%int64(bb.devices))
+					for pb.Next() {
+						err := store.InTx(deviceID, func(d *domain.SignatureDevice, tx persistence.Tx) error {
+							time.Sleep(signTime)
+							d.SignatureCounter++
+							return nil
+						})
+						if err != nil {
+							b.Fatal(err)
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,377 @@
+// Package storetest provides a conformance test suite for persistence.DeviceStore implementations.
+//
+// Every implementation should pass it, preferably with the race detector enabled:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) persistence.DeviceStore {
+//			return NewMyStore()
+//		})
+//	}
+package storetest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+// Concurrency settings of the concurrent InTx tests.
+const (
+	goroutines     = 8
+	txPerGoroutine = 25
+
+	concurrentDeviceID = "concurrent-device"
+)
+
+// NewStoreFunc creates a new, empty store. It is called once per test.
+type NewStoreFunc func(t *testing.T) persistence.DeviceStore
+
+// Run runs the whole conformance suite against the stores created by newStore.
+func Run(t *testing.T, newStore NewStoreFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, store persistence.DeviceStore)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"CreateDuplicate", testCreateDuplicate},
+		{"GetUnknown", testGetUnknown},
+		{"Update", testUpdate},
+		{"UpdateUnknown", testUpdateUnknown},
+		{"List", testList},
+		{"InTxCommits", testInTxCommits},
+		{"InTxRollsBack", testInTxRollsBack},
+		{"InTxUnknown", testInTxUnknown},
+		{"Signatures", testSignatures},
+		{"IdempotencyKeys", testIdempotencyKeys},
+		{"ConcurrentInTxSameDevice", testConcurrentInTxSameDevice},
+		{"ConcurrentInTxDifferentDevices", testConcurrentInTxDifferentDevices},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+func newDevice(id string) domain.SignatureDevice {
+	return domain.SignatureDevice{
+		ID:                id,
+		Label:             "Label " + id,
+		Algorithm:         domain.AlgorithmECC,
+		KeySize:           384,
+		PublicKey:         []byte("public-" + id),
+		KeyHandle:         "key-" + id,
+		Scheme:            "ECDSA_P384_SHA256",
+		Status:            domain.StatusActive,
+		CertificateChain:  []byte("certificate-" + id),
+		TransactionSchema: "RECEIPT",
+		KeyVersions: []domain.KeyVersion{{
+			Version:   1,
+			PublicKey: []byte("public-" + id),
+			KeySize:   384,
+			Scheme:    "ECDSA_P384_SHA256",
+			CreatedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		}},
+	}
+}
+
+// sign increments the counter of a device and records a signature, like the signing service does.
+func sign(store persistence.DeviceStore, deviceID string) error {
+	return store.InTx(deviceID, func(d *domain.SignatureDevice, tx persistence.Tx) error {
+		signature := fmt.Sprintf("signature-%d", d.SignatureCounter)
+		tx.AddSignature(domain.Signature{
+			DeviceID:   d.ID,
+			Counter:    d.SignatureCounter,
+			Signature:  signature,
+			Scheme:     d.Scheme,
+			KeyVersion: len(d.KeyVersions),
+			DataFormat: 1,
+			SignedData: fmt.Sprintf("%d_data_%s", d.SignatureCounter, d.LastSignature),
+			CreatedAt:  time.Now().UTC(),
+		})
+		d.LastSignature = signature
+		d.SignatureCounter++
+		return nil
+	})
+}
+
+func testCreateAndGet(t *testing.T, store persistence.DeviceStore) {
+	device := newDevice("device-1")
+	require.NoError(t, store.Create(device))
+
+	got, err := store.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, device, got)
+}
+
+func testCreateDuplicate(t *testing.T, store persistence.DeviceStore) {
+	require.NoError(t, store.Create(newDevice("device-1")))
+
+	duplicate := newDevice("device-1")
+	duplicate.Label = "Other"
+	assert.ErrorIs(t, store.Create(duplicate), persistence.ErrDeviceExists)
+
+	got, err := store.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, "Label device-1", got.Label, "duplicate must not overwrite the existing device")
+}
+
+func testGetUnknown(t *testing.T, store persistence.DeviceStore) {
+	_, err := store.Get("unknown")
+	assert.ErrorIs(t, err, persistence.ErrDeviceNotFound)
+}
+
+func testUpdate(t *testing.T, store persistence.DeviceStore) {
+	device := newDevice("device-1")
+	require.NoError(t, store.Create(device))
+
+	device.Label = "Updated"
+	device.Status = domain.StatusDecommissioned
+	device.KeyHandle = ""
+	device.SignatureCounter = 7
+	device.KeyVersions = append(device.KeyVersions, domain.KeyVersion{
+		Version:       2,
+		PublicKey:     []byte("rotated"),
+		FromCounter:   5,
+		LinkSignature: "link",
+		CreatedAt:     time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	})
+	require.NoError(t, store.Update(device))
+
+	got, err := store.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, device, got)
+}
+
+func testUpdateUnknown(t *testing.T, store persistence.DeviceStore) {
+	assert.ErrorIs(t, store.Update(newDevice("unknown")), persistence.ErrDeviceNotFound)
+
+	_, err := store.Get("unknown")
+	assert.ErrorIs(t, err, persistence.ErrDeviceNotFound, "update must not create a device")
+}
+
+func testList(t *testing.T, store persistence.DeviceStore) {
+	for _, id := range []string{"c", "a", "d", "b"} {
+		device := newDevice(id)
+		if id == "b" {
+			device.Algorithm = domain.AlgorithmRSA
+		}
+		require.NoError(t, store.Create(device))
+	}
+
+	ids := func(filter persistence.ListFilter) []string {
+		t.Helper()
+		devices, err := store.List(filter)
+		require.NoError(t, err)
+		result := make([]string, 0, len(devices))
+		for _, device := range devices {
+			result = append(result, device.ID)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"a", "b", "c", "d"}, ids(persistence.ListFilter{}))
+	assert.Equal(t, []string{"a", "b"}, ids(persistence.ListFilter{Limit: 2}))
+	assert.Equal(t, []string{"c", "d"}, ids(persistence.ListFilter{AfterID: "b"}))
+	assert.Equal(t, []string{"a", "c", "d"}, ids(persistence.ListFilter{Algorithm: domain.AlgorithmECC}))
+	assert.Equal(t, []string{"c"}, ids(persistence.ListFilter{LabelPrefix: "Label c"}))
+	assert.Empty(t, ids(persistence.ListFilter{LabelPrefix: "label"}), "label prefix is case-sensitive")
+}
+
+func testInTxCommits(t *testing.T, store persistence.DeviceStore) {
+	require.NoError(t, store.Create(newDevice("device-1")))
+	require.NoError(t, sign(store, "device-1"))
+
+	got, err := store.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), got.SignatureCounter)
+	assert.Equal(t, "signature-0", got.LastSignature)
+
+	signature, err := store.GetSignature("device-1", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "signature-0", signature.Signature)
+	assert.Equal(t, "ECDSA_P384_SHA256", signature.Scheme)
+	assert.Equal(t, 1, signature.KeyVersion)
+	assert.Equal(t, 1, signature.DataFormat)
+}
+
+func testInTxRollsBack(t *testing.T, store persistence.DeviceStore) {
+	device := newDevice("device-1")
+	require.NoError(t, store.Create(device))
+
+	errFailed := errors.New("failed")
+	err := store.InTx("device-1", func(d *domain.SignatureDevice, tx persistence.Tx) error {
+		tx.AddSignature(domain.Signature{DeviceID: d.ID, Counter: d.SignatureCounter, Signature: "lost"})
+		d.SignatureCounter++
+		d.Label = "changed"
+		return errFailed
+	})
+	assert.ErrorIs(t, err, errFailed, "error of fn must be returned")
+
+	got, err := store.Get("device-1")
+	require.NoError(t, err)
+	assert.Equal(t, device, got, "device must be unchanged")
+
+	_, err = store.GetSignature("device-1", 0)
+	assert.ErrorIs(t, err, persistence.ErrSignatureNotFound, "signature must not be written")
+}
+
+func testIdempotencyKeys(t *testing.T, store persistence.DeviceStore) {
+	require.NoError(t, store.Create(newDevice("device-1")))
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := domain.IdempotencyKey{DeviceID: "device-1", Key: "first", RequestHash: "hash-1", Counter: 0, CreatedAt: created}
+	second := domain.IdempotencyKey{DeviceID: "device-1", Key: "second", RequestHash: "hash-2", Counter: 1, CreatedAt: created.Add(time.Hour)}
+
+	require.NoError(t, store.InTx("device-1", func(d *domain.SignatureDevice, tx persistence.Tx) error {
+		tx.PutIdempotencyKey(first)
+		tx.PutIdempotencyKey(second)
+		return nil
+	}))
+
+	got, err := store.GetIdempotencyKey("device-1", "first")
+	require.NoError(t, err)
+	assert.Equal(t, first, got)
+
+	_, err = store.GetIdempotencyKey("device-1", "unknown")
+	assert.ErrorIs(t, err, persistence.ErrIdempotencyKeyNotFound)
+	_, err = store.GetIdempotencyKey("unknown", "first")
+	assert.ErrorIs(t, err, persistence.ErrDeviceNotFound)
+
+	err = store.InTx("device-1", func(d *domain.SignatureDevice, tx persistence.Tx) error {
+		tx.PutIdempotencyKey(domain.IdempotencyKey{DeviceID: "device-1", Key: "lost", CreatedAt: created})
+		return errors.New("failed")
+	})
+	require.Error(t, err)
+	_, err = store.GetIdempotencyKey("device-1", "lost")
+	assert.ErrorIs(t, err, persistence.ErrIdempotencyKeyNotFound, "key must not be written on rollback")
+
+	replaced := first
+	replaced.RequestHash = "hash-3"
+	replaced.CreatedAt = created.Add(2 * time.Hour)
+	require.NoError(t, store.InTx("device-1", func(d *domain.SignatureDevice, tx persistence.Tx) error {
+		tx.ExpireIdempotencyKeys(created.Add(90 * time.Minute))
+		tx.PutIdempotencyKey(replaced)
+		return nil
+	}))
+
+	got, err = store.GetIdempotencyKey("device-1", "first")
+	require.NoError(t, err)
+	assert.Equal(t, replaced, got, "expired key must be replaceable")
+	_, err = store.GetIdempotencyKey("device-1", "second")
+	assert.ErrorIs(t, err, persistence.ErrIdempotencyKeyNotFound, "expired key must be deleted")
+}
+
+func testInTxUnknown(t *testing.T, store persistence.DeviceStore) {
+	called := false
+	err := store.InTx("unknown", func(d *domain.SignatureDevice, tx persistence.Tx) error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, persistence.ErrDeviceNotFound)
+	assert.False(t, called, "fn must not be called for an unknown device")
+}
+
+func testSignatures(t *testing.T, store persistence.DeviceStore) {
+	require.NoError(t, store.Create(newDevice("device-1")))
+	require.NoError(t, store.Create(newDevice("device-2")))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sign(store, "device-1"))
+	}
+	require.NoError(t, sign(store, "device-2"))
+
+	signatures, err := store.ListSignatures("device-1", persistence.SignatureFilter{FromCounter: 1, Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, signatures, 3)
+	for i, signature := range signatures {
+		assert.Equal(t, "device-1", signature.DeviceID)
+		assert.Equal(t, uint64(i+1), signature.Counter)
+	}
+
+	signatures, err = store.ListSignatures("device-1", persistence.SignatureFilter{FromCounter: 5})
+	require.NoError(t, err)
+	assert.Empty(t, signatures)
+
+	_, err = store.GetSignature("device-1", 5)
+	assert.ErrorIs(t, err, persistence.ErrSignatureNotFound)
+	_, err = store.GetSignature("unknown", 0)
+	assert.ErrorIs(t, err, persistence.ErrDeviceNotFound)
+	_, err = store.ListSignatures("unknown", persistence.SignatureFilter{})
+	assert.ErrorIs(t, err, persistence.ErrDeviceNotFound)
+}
+
+func testConcurrentInTxSameDevice(t *testing.T, store persistence.DeviceStore) {
+	require.NoError(t, store.Create(newDevice(concurrentDeviceID)))
+
+	runConcurrently(t, func(int) string { return concurrentDeviceID }, store)
+
+	total := uint64(goroutines * txPerGoroutine)
+	got, err := store.Get(concurrentDeviceID)
+	require.NoError(t, err)
+	assert.Equal(t, total, got.SignatureCounter, "no increment may be lost")
+
+	// The chain must be gapless: every signature links to its predecessor.
+	signatures, err := store.ListSignatures(concurrentDeviceID, persistence.SignatureFilter{})
+	require.NoError(t, err)
+	require.Len(t, signatures, int(total))
+	for i, signature := range signatures {
+		assert.Equal(t, uint64(i), signature.Counter)
+		if i > 0 {
+			assert.Equal(t, fmt.Sprintf("%d_data_%s", i, signatures[i-1].Signature), signature.SignedData)
+		}
+	}
+}
+
+func testConcurrentInTxDifferentDevices(t *testing.T, store persistence.DeviceStore) {
+	deviceID := func(goroutine int) string { return fmt.Sprintf("device-%d", goroutine) }
+	for i := 0; i < goroutines; i++ {
+		require.NoError(t, store.Create(newDevice(deviceID(i))))
+	}
+
+	runConcurrently(t, deviceID, store)
+
+	for i := 0; i < goroutines; i++ {
+		got, err := store.Get(deviceID(i))
+		require.NoError(t, err)
+		assert.Equal(t, uint64(txPerGoroutine), got.SignatureCounter)
+	}
+}
+
+// runConcurrently signs txPerGoroutine times in each of the goroutines,
+// while reading from the store at the same time.
+func runConcurrently(t *testing.T, deviceID func(goroutine int) string, store persistence.DeviceStore) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*txPerGoroutine*3)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(goroutine int) {
+			defer wg.Done()
+			for j := 0; j < txPerGoroutine; j++ {
+				if err := sign(store, deviceID(goroutine)); err != nil {
+					errs <- err
+				}
+				if _, err := store.Get(deviceID(goroutine)); err != nil {
+					errs <- err
+				}
+				if _, err := store.List(persistence.ListFilter{Limit: 10}); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent operation failed: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package schema
+
+// Receipt is the name of the built-in schema of fiscal receipts.
+const Receipt = "RECEIPT"
+
+// receiptSchema is a fiscal receipt: the gross amount in a currency, broken down into VAT lines,
+// and when the transaction took place.
+const receiptSchema = `{
+	"type": "object",
+	"required": ["amount", "currency", "vat_lines", "timestamp"],
+	"additionalProperties": false,
+	"properties": {
+		"amount": {"type": "number"},
+		"currency": {"type": "string", "pattern": "^[A-Z]{3}$"},
+		"vat_lines": {
+			"type": "array",
+			"minItems": 1,
+			"items": {
+				"type": "object",
+				"required": ["rate", "net", "vat"],
+				"additionalProperties": false,
+				"properties": {
+					"rate": {"type": "number", "minimum": 0, "maximum": 100},
+					"net": {"type": "number"},
+					"vat": {"type": "number"}
+				}
+			}
+		},
+		"timestamp": {"type": "string", "format": "date-time"}
+	}
+}`
+
+func init() {
+	receipt, err := Parse([]byte(receiptSchema))
+	if err != nil {
+		panic(err)
+	}
+	Register(Receipt, receipt)
+}
@@ -0,0 +1,303 @@
+// Package schema validates transactions against the schema a device is bound to and brings them
+// into the canonical form that is signed.
+//
+// Schemas are written in a subset of JSON Schema: the keywords type, properties, required,
+// additionalProperties (as a boolean), items, minItems, maxItems, minLength, maxLength, minimum,
+// maximum, pattern, enum and format, of which only "date-time" (RFC 3339) is checked.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownSchema = errors.New("unknown transaction schema")
+	ErrInvalidSchema = errors.New("invalid transaction schema")
+)
+
+// Schema describes valid JSON values. Unset keywords do not restrict the value.
+type Schema struct {
+	Type                 string             `json:"type,omitempty"` // object, array, string, number, integer or boolean
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Format               string             `json:"format,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Parse reads a schema in the supported subset of JSON Schema and compiles its patterns.
+func Parse(document []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(document, &s); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) compile() error {
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%w: pattern %q: %v", ErrInvalidSchema, s.Pattern, err)
+		}
+		s.pattern = pattern
+	}
+	for _, property := range s.Properties {
+		if err := property.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+// FieldError is a violation of the schema by a single field.
+type FieldError struct {
+	Field   string // path of the field, like vat_lines[0].rate, empty for the transaction itself
+	Message string
+}
+
+func (e FieldError) String() string {
+	if e.Field == "" {
+		return e.Message
+	}
+	return e.Field + ": " + e.Message
+}
+
+// Validate checks a decoded JSON value against the schema and returns all violations,
+// ordered by field. Numbers may be decoded as float64 or, to keep their exact value, as json.Number.
+func (s *Schema) Validate(value interface{}) []FieldError {
+	var errs []FieldError
+	s.validate("", value, &errs)
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+func (s *Schema) validate(path string, value interface{}, errs *[]FieldError) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Field: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.Type != "" && !hasType(value, s.Type) {
+		fail("must be of type %s", s.Type)
+		return
+	}
+	if len(s.Enum) > 0 && !contains(s.Enum, value) {
+		fail("must be one of %s", formatEnum(s.Enum))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, present := v[name]; !present {
+				*errs = append(*errs, FieldError{Field: join(path, name), Message: "is required"})
+			}
+		}
+		for name, field := range v {
+			property, known := s.Properties[name]
+			if !known {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					*errs = append(*errs, FieldError{Field: join(path, name), Message: "is not allowed"})
+				}
+				continue
+			}
+			property.validate(join(path, name), field, errs)
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match %s", s.Pattern)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				fail("must be an RFC 3339 date-time")
+			}
+		}
+
+	case json.Number, float64:
+		n, ok := number(v)
+		if !ok {
+			fail("must be a finite number")
+			return
+		}
+		if s.Minimum != nil && n.Cmp(new(big.Rat).SetFloat64(*s.Minimum)) < 0 {
+			fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && n.Cmp(new(big.Rat).SetFloat64(*s.Maximum)) > 0 {
+			fail("must be at most %v", *s.Maximum)
+		}
+	}
+}
+
+// number returns the exact value of a decoded JSON number. The text of a json.Number is parsed
+// as a decimal, so large or precise numbers like 12345678901234567890.10 are not rounded.
+func number(value interface{}) (*big.Rat, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		return new(big.Rat).SetString(string(v))
+	case float64:
+		n := new(big.Rat).SetFloat64(v)
+		return n, n != nil
+	default:
+		return nil, false
+	}
+}
+
+func hasType(value interface{}, typ string) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case json.Number, float64:
+		n, ok := number(v)
+		return ok && (typ == "number" || typ == "integer" && n.IsInt())
+	default:
+		return false
+	}
+}
+
+func contains(enum []interface{}, value interface{}) bool {
+	n, isNumber := number(value)
+	for _, allowed := range enum {
+		if allowedNumber, ok := number(allowed); ok && isNumber {
+			if allowedNumber.Cmp(n) == 0 {
+				return true
+			}
+			continue
+		}
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEnum(enum []interface{}) string {
+	values := make([]string, 0, len(enum))
+	for _, value := range enum {
+		values = append(values, fmt.Sprint(value))
+	}
+	return strings.Join(values, ", ")
+}
+
+func join(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// Canonicalize returns the canonical form of a JSON document: without insignificant whitespace
+// and with object keys in ascending order. Numbers are kept exactly as written, like 11.90, since
+// converting them to floating point would round amounts like 12345678901234567890.10.
+// The value is returned decoded, too, with numbers as json.Number.
+func Canonicalize(document []byte) ([]byte, interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, nil, err
+	}
+	if decoder.More() {
+		return nil, nil, errors.New("unexpected data after the JSON value")
+	}
+
+	// encoding/json writes map keys in sorted order and json.Number verbatim.
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, nil, err
+	}
+	return bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), value, nil
+}
+
+var (
+	schemas      = make(map[string]*Schema)
+	schemasMutex sync.RWMutex
+)
+
+// Register makes a schema available to devices under its name. It panics if the name is taken.
+func Register(name string, s *Schema) {
+	schemasMutex.Lock()
+	defer schemasMutex.Unlock()
+
+	if _, exists := schemas[name]; exists {
+		panic("schema: transaction schema registered twice: " + name)
+	}
+	schemas[name] = s
+}
+
+// Lookup returns the registered schema with the name.
+func Lookup(name string) (*Schema, error) {
+	schemasMutex.RLock()
+	defer schemasMutex.RUnlock()
+
+	s, exists := schemas[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSchema, name)
+	}
+	return s, nil
+}
+
+// Names returns the names of all registered schemas in alphabetical order.
+func Names() []string {
+	schemasMutex.RLock()
+	defer schemasMutex.RUnlock()
+
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,109 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/schema"
+)
+
+const validReceipt = `{"amount": 11.9, "currency": "EUR", "vat_lines": [{"rate": 19, "net": 10, "vat": 1.9}], "timestamp": "2024-05-01T12:00:00Z"}`
+
+func TestReceipt(t *testing.T) {
+	receipt, err := schema.Lookup(schema.Receipt)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		document string
+		expected []string
+	}{
+		{name: "Valid", document: validReceipt},
+		{
+			name:     "Missing fields",
+			document: `{"amount": 1}`,
+			expected: []string{"currency: is required", "timestamp: is required", "vat_lines: is required"},
+		},
+		{
+			name:     "Wrong types",
+			document: `{"amount": "1.00", "currency": "EUR", "vat_lines": {}, "timestamp": "2024-05-01T12:00:00Z"}`,
+			expected: []string{"amount: must be of type number", "vat_lines: must be of type array"},
+		},
+		{
+			name:     "Invalid values",
+			document: `{"amount": 1, "currency": "eur", "vat_lines": [{"rate": 119, "net": 1, "vat": 0, "note": ""}], "timestamp": "yesterday"}`,
+			expected: []string{
+				"currency: must match ^[A-Z]{3}$",
+				"timestamp: must be an RFC 3339 date-time",
+				"vat_lines[0].note: is not allowed",
+				"vat_lines[0].rate: must be at most 100",
+			},
+		},
+		{
+			name:     "No VAT lines",
+			document: `{"amount": 0, "currency": "EUR", "vat_lines": [], "timestamp": "2024-05-01T12:00:00+02:00"}`,
+			expected: []string{"vat_lines: must have at least 1 items"},
+		},
+		{name: "Not an object", document: `[]`, expected: []string{"must be of type object"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			require.NoError(t, json.Unmarshal([]byte(tt.document), &value))
+
+			var errs []string
+			for _, fieldErr := range receipt.Validate(value) {
+				errs = append(errs, fieldErr.String())
+			}
+			assert.Equal(t, tt.expected, errs)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	s, err := schema.Parse([]byte(`{"type": "object", "properties": {"n": {"type": "integer", "enum": [1, 2]}}}`))
+	require.NoError(t, err)
+	assert.Empty(t, s.Validate(map[string]interface{}{"n": float64(2)}))
+	assert.Equal(t, []schema.FieldError{{Field: "n", Message: "must be of type integer"}}, s.Validate(map[string]interface{}{"n": 1.5}))
+	assert.Equal(t, []schema.FieldError{{Field: "n", Message: "must be one of 1, 2"}}, s.Validate(map[string]interface{}{"n": float64(3)}))
+
+	_, err = schema.Parse([]byte(`{"pattern": "("}`))
+	assert.ErrorIs(t, err, schema.ErrInvalidSchema)
+
+	_, err = schema.Lookup("INVOICE")
+	assert.ErrorIs(t, err, schema.ErrUnknownSchema)
+}
+
+func TestCanonicalize(t *testing.T) {
+	canonical, _, err := schema.Canonicalize([]byte(`{
+		"timestamp": "2024-05-01T12:00:00Z",
+		"amount": 11.90,
+		"vat_lines": [{"vat": 1.9, "rate": 19, "net": 1e1}],
+		"currency": "EUR",
+		"note": "<&>"
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"amount":11.90,"currency":"EUR","note":"<&>","timestamp":"2024-05-01T12:00:00Z","vat_lines":[{"net":1e1,"rate":19,"vat":1.9}]}`, string(canonical))
+
+	// Numbers beyond the precision of float64 are neither rounded when signed nor when validated.
+	canonical, value, err := schema.Canonicalize([]byte(`{"amount": 12345678901234567890.10, "count": 12345678901234567891}`))
+	require.NoError(t, err)
+	assert.Equal(t, `{"amount":12345678901234567890.10,"count":12345678901234567891}`, string(canonical))
+	s, err := schema.Parse([]byte(`{"properties": {
+		"amount": {"type": "number", "maximum": 12345678901234567890},
+		"count": {"type": "integer", "enum": [12345678901234567890]}
+	}}`))
+	require.NoError(t, err)
+	assert.Equal(t, []schema.FieldError{
+		{Field: "amount", Message: "must be at most 1.2345678901234567e+19"},
+		{Field: "count", Message: "must be one of 1.2345678901234567e+19"},
+	}, s.Validate(value))
+
+	for _, document := range []string{``, `{"amount": }`, `{} {}`} {
+		_, _, err := schema.Canonicalize([]byte(document))
+		assert.Error(t, err, document)
+	}
+}
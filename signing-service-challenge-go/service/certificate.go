@@ -0,0 +1,160 @@
+package service
+
+import (
+	"crypto"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+const (
+	DefaultCertificateValidity = 365 * 24 * time.Hour
+	MaxCertificateValidity     = 10 * 365 * 24 * time.Hour
+)
+
+var ErrCertificateNotFound = errors.New("certificate not found")
+
+// CertificateParams is the subject of a certificate or certificate signing request.
+type CertificateParams struct {
+	CommonName   string        // empty means the device ID
+	Organization string        // optional
+	Validity     time.Duration // self-signed certificates only, 0 means DefaultCertificateValidity
+}
+
+func (p CertificateParams) subject(device domain.SignatureDevice) pkix.Name {
+	subject := pkix.Name{CommonName: p.CommonName}
+	if subject.CommonName == "" {
+		subject.CommonName = device.ID
+	}
+	if p.Organization != "" {
+		subject.Organization = []string{p.Organization}
+	}
+	return subject
+}
+
+// IssueSelfSignedCertificate issues a certificate for the device key, signed by the key itself
+// with the device's scheme, and stores it as the device's certificate chain.
+// It replaces any certificate chain the device had.
+func (s *DeviceService) IssueSelfSignedCertificate(deviceID string, params CertificateParams) ([]byte, error) {
+	validity := params.Validity
+	if validity == 0 {
+		validity = DefaultCertificateValidity
+	}
+	if validity < 0 || validity > MaxCertificateValidity {
+		return nil, fmt.Errorf("%w: validity must be positive and at most %d days", ErrInvalidInput, MaxCertificateValidity/(24*time.Hour))
+	}
+
+	var chain []byte
+	operation := func(device *domain.SignatureDevice, tx persistence.Tx) error {
+		signer, scheme, err := s.deviceSigner(*device)
+		if err != nil {
+			return err
+		}
+
+		notBefore := time.Now().UTC().Truncate(time.Second)
+		certificate, err := crypt.SelfSignedCertificate(signer, scheme, params.subject(*device), notBefore, notBefore.Add(validity))
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSigningFailed, err)
+		}
+
+		chain = crypt.EncodeCertificates(certificate)
+		device.CertificateChain = chain
+		return nil
+	}
+
+	if err := s.store.InTx(deviceID, operation); err != nil {
+		return nil, storeError(err)
+	}
+
+	return chain, nil
+}
+
+// CreateCertificateRequest creates a PEM encoded PKCS#10 certificate signing request for the
+// device key, to have it certified by a certificate authority.
+func (s *DeviceService) CreateCertificateRequest(deviceID string, params CertificateParams) ([]byte, error) {
+	device, err := s.store.Get(deviceID)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	signer, scheme, err := s.deviceSigner(device)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := crypt.CertificateRequest(signer, scheme, params.subject(device))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSigningFailed, err)
+	}
+
+	return crypt.EncodeCertificateRequest(request), nil
+}
+
+// UploadCertificateChain stores a PEM encoded certificate chain for the device. The first
+// certificate must be issued for the device key and each one must be signed by the next.
+func (s *DeviceService) UploadCertificateChain(deviceID string, chain []byte) error {
+	certificates, err := crypt.ParseCertificateChain(chain)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+
+	operation := func(device *domain.SignatureDevice, tx persistence.Tx) error {
+		publicKey, err := crypt.DERMarshaler{}.DecodePublicKey(device.PublicKey)
+		if err != nil {
+			return fmt.Errorf("loading public key: %w", err)
+		}
+		if err := crypt.VerifyCertificateChain(certificates, publicKey); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+		}
+
+		// Store the chain re-encoded, without any text around the PEM blocks.
+		encoded := make([][]byte, len(certificates))
+		for i, certificate := range certificates {
+			encoded[i] = certificate.Raw
+		}
+		device.CertificateChain = crypt.EncodeCertificates(encoded...)
+		return nil
+	}
+
+	if err := s.store.InTx(deviceID, operation); err != nil {
+		return storeError(err)
+	}
+
+	return nil
+}
+
+// GetCertificateChain returns the PEM encoded certificate chain of a device.
+func (s *DeviceService) GetCertificateChain(deviceID string) ([]byte, error) {
+	device, err := s.store.Get(deviceID)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	if len(device.CertificateChain) == 0 {
+		return nil, ErrCertificateNotFound
+	}
+	return device.CertificateChain, nil
+}
+
+// deviceSigner returns a crypto.Signer for the device key and the scheme the device signs with.
+// Like for transactions, only active devices can use their key.
+func (s *DeviceService) deviceSigner(device domain.SignatureDevice) (crypto.Signer, crypt.SignatureScheme, error) {
+	if err := checkActive(device); err != nil {
+		return nil, crypt.SignatureScheme{}, err
+	}
+
+	scheme, err := signatureScheme(device)
+	if err != nil {
+		return nil, crypt.SignatureScheme{}, err
+	}
+
+	signer, err := s.keys.Signer(device.KeyHandle)
+	if err != nil {
+		return nil, crypt.SignatureScheme{}, fmt.Errorf("%w: %v", ErrSigningFailed, err)
+	}
+	return signer, scheme, nil
+}
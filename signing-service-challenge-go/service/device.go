@@ -0,0 +1,181 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+type CreateDeviceParams struct {
+	ID        string
+	Algorithm string
+	Label     string
+	KeySize   int    // bits, 0 means the default of the algorithm
+	Curve     string // alternative to KeySize for ECC, like "P-256"
+	Scheme    string // signature scheme like RSA_PSS_SHA256, empty means the algorithm's default
+	// TransactionSchema binds the device to a schema like schema.Receipt, which every transaction
+	// it signs must follow. Empty means free-form transactions.
+	TransactionSchema string
+}
+
+type ListDevicesParams struct {
+	Cursor      string // from DevicePage.NextCursor, empty for the first page
+	Limit       int    // 0 means DefaultPageSize
+	Algorithm   string
+	LabelPrefix string
+}
+
+type DevicePage struct {
+	Devices    []domain.SignatureDevice
+	NextCursor string // empty on the last page
+}
+
+// CreateDevice generates a new key pair with the requested algorithm and size and stores a device
+// with it, which signs with the requested scheme.
+// The device gets a generated UUID if params.ID is empty, otherwise the ID must be a UUID itself.
+// Creating a device again with the same algorithm, key size, scheme and transaction schema returns
+// the existing one, so clients can retry safely, created is false then. Different parameters for an
+// existing ID are ErrDeviceExists.
+// The key is destroyed again if the device cannot be stored.
+func (s *DeviceService) CreateDevice(params CreateDeviceParams) (domain.SignatureDevice, bool, error) {
+	keySize, scheme, err := s.keyPolicy.keySpec(params)
+	if err != nil {
+		return domain.SignatureDevice{}, false, err
+	}
+	if err := lookupTransactionSchema(params.TransactionSchema); err != nil {
+		return domain.SignatureDevice{}, false, err
+	}
+
+	if params.ID == "" {
+		id, err := uuid.NewV7()
+		if err != nil {
+			return domain.SignatureDevice{}, false, err
+		}
+		params.ID = id.String()
+	} else {
+		if err := validateDeviceID(params.ID); err != nil {
+			return domain.SignatureDevice{}, false, err
+		}
+		// Check before generating a key, which is expensive for RSA.
+		if existing, err := s.store.Get(params.ID); err == nil {
+			return existingDevice(existing, params, keySize, scheme)
+		} else if !errors.Is(err, persistence.ErrDeviceNotFound) {
+			return domain.SignatureDevice{}, false, storeError(err)
+		}
+	}
+
+	handle, publicKey, err := s.generateKey(params.Algorithm, keySize)
+	if err != nil {
+		return domain.SignatureDevice{}, false, err
+	}
+
+	device := domain.SignatureDevice{
+		ID:                params.ID,
+		Algorithm:         params.Algorithm,
+		Label:             params.Label,
+		KeySize:           keySize,
+		PublicKey:         publicKey,
+		KeyHandle:         handle,
+		Scheme:            scheme,
+		Status:            domain.StatusActive,
+		TransactionSchema: params.TransactionSchema,
+		KeyVersions: []domain.KeyVersion{{
+			Version:   1,
+			PublicKey: publicKey,
+			KeySize:   keySize,
+			Scheme:    scheme,
+			CreatedAt: time.Now().UTC(),
+		}},
+	}
+	if err := s.store.Create(device); err != nil {
+		s.keys.Destroy(handle)
+		if !errors.Is(err, persistence.ErrDeviceExists) {
+			return domain.SignatureDevice{}, false, storeError(err)
+		}
+		// A concurrent request created the device in the meantime.
+		existing, err := s.store.Get(params.ID)
+		if err != nil {
+			return domain.SignatureDevice{}, false, storeError(err)
+		}
+		return existingDevice(existing, params, keySize, scheme)
+	}
+
+	return device, true, nil
+}
+
+// validateDeviceID accepts UUIDs in their canonical, lower case form,
+// so that every device has exactly one ID to look it up by.
+func validateDeviceID(id string) error {
+	parsed, err := uuid.Parse(id)
+	if err != nil || parsed.String() != id || parsed == uuid.Nil {
+		return fmt.Errorf("%w: id must be a lower case UUID", ErrInvalidInput)
+	}
+	return nil
+}
+
+// existingDevice returns the device if it was created with the requested parameters. Only those
+// that cannot change afterwards are compared, the label and the status can be updated since.
+func existingDevice(device domain.SignatureDevice, params CreateDeviceParams, keySize int, scheme string) (domain.SignatureDevice, bool, error) {
+	deviceKeySize := device.KeySize
+	if alg, err := crypt.LookupAlgorithm(device.Algorithm); err == nil && deviceKeySize == 0 {
+		deviceKeySize = alg.DefaultKeySize // created before key sizes were recorded
+	}
+
+	if device.Algorithm != params.Algorithm || deviceKeySize != keySize ||
+		DeviceScheme(device) != scheme || device.TransactionSchema != params.TransactionSchema {
+		return domain.SignatureDevice{}, false, fmt.Errorf("%w: %s has different parameters", ErrDeviceExists, device.ID)
+	}
+	return device, false, nil
+}
+
+func (s *DeviceService) GetDevice(id string) (domain.SignatureDevice, error) {
+	device, err := s.store.Get(id)
+	if err != nil {
+		return domain.SignatureDevice{}, storeError(err)
+	}
+	return device, nil
+}
+
+// ListDevices pages through the devices ordered by ID.
+func (s *DeviceService) ListDevices(params ListDevicesParams) (DevicePage, error) {
+	limit, err := pageLimit(params.Limit)
+	if err != nil {
+		return DevicePage{}, err
+	}
+
+	afterID, err := decodeCursor(params.Cursor)
+	if err != nil {
+		return DevicePage{}, err
+	}
+
+	if params.Algorithm != "" {
+		if _, err := crypt.LookupAlgorithm(params.Algorithm); err != nil {
+			return DevicePage{}, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, params.Algorithm)
+		}
+	}
+
+	// Fetch one device more than requested to find out whether there is a next page.
+	devices, err := s.store.List(persistence.ListFilter{
+		AfterID:     afterID,
+		Limit:       limit + 1,
+		Algorithm:   params.Algorithm,
+		LabelPrefix: params.LabelPrefix,
+	})
+	if err != nil {
+		return DevicePage{}, storeError(err)
+	}
+
+	page := DevicePage{Devices: devices}
+	if len(devices) > limit {
+		page.Devices = devices[:limit]
+		page.NextCursor = encodeCursor(devices[limit-1].ID)
+	}
+
+	return page, nil
+}
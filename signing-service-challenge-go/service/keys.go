@@ -0,0 +1,100 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/keys"
+)
+
+// generateKey creates a key pair in the key provider and returns its handle and public key.
+func (s *DeviceService) generateKey(algorithm string, keySize int) (handle string, publicKey []byte, err error) {
+	handle, err = s.keys.Generate(algorithm, keySize)
+	if errors.Is(err, keys.ErrUnsupportedAlgorithm) {
+		return "", nil, ErrUnsupportedAlgorithm
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("key generation failed: %w", err)
+	}
+
+	publicKey, err = s.keys.PublicKey(handle)
+	if err != nil {
+		s.keys.Destroy(handle)
+		return "", nil, err
+	}
+
+	return handle, publicKey, nil
+}
+
+// discardKey destroys a key that was created for a failed operation and returns the operation's
+// error. If the key cannot be destroyed, that is added to the error, as the key is left behind.
+func (s *DeviceService) discardKey(handle string, err error) error {
+	if destroyErr := s.keys.Destroy(handle); destroyErr != nil {
+		return fmt.Errorf("%w (unused key %s could not be destroyed: %v)", err, handle, destroyErr)
+	}
+	return err
+}
+
+// signatureScheme returns the scheme a device signs with. Devices created before schemes could be
+// chosen have none stored and sign with the default scheme of their algorithm.
+func signatureScheme(device domain.SignatureDevice) (crypt.SignatureScheme, error) {
+	return crypt.LookupScheme(DeviceScheme(device))
+}
+
+// DeviceScheme returns the name of the signature scheme a device signs with.
+func DeviceScheme(device domain.SignatureDevice) string {
+	if device.Scheme != "" {
+		return device.Scheme
+	}
+
+	alg, err := crypt.LookupAlgorithm(device.Algorithm)
+	if err != nil {
+		return ""
+	}
+	keySize := device.KeySize
+	if keySize == 0 {
+		keySize = alg.DefaultKeySize
+	}
+	return alg.DefaultScheme(keySize)
+}
+
+// KeyVersions returns the keys of a device in order, the last one is the current key.
+// Devices created before key versions were recorded have a single version with their key.
+func KeyVersions(device domain.SignatureDevice) []domain.KeyVersion {
+	if len(device.KeyVersions) > 0 {
+		return device.KeyVersions
+	}
+	return []domain.KeyVersion{{
+		Version:   1,
+		PublicKey: device.PublicKey,
+		KeySize:   device.KeySize,
+		Scheme:    DeviceScheme(device),
+	}}
+}
+
+// currentKeyVersion returns the key a device signs with now.
+func currentKeyVersion(device domain.SignatureDevice) domain.KeyVersion {
+	versions := KeyVersions(device)
+	return versions[len(versions)-1]
+}
+
+// keyVersionAt returns the key version that signed the counter.
+func keyVersionAt(device domain.SignatureDevice, counter uint64) domain.KeyVersion {
+	versions := KeyVersions(device)
+	for i := len(versions) - 1; i > 0; i-- {
+		if counter >= versions[i].FromCounter {
+			return versions[i]
+		}
+	}
+	return versions[0]
+}
+
+func newVerifier(version domain.KeyVersion) (crypt.Verifier, error) {
+	scheme, err := crypt.LookupScheme(version.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.NewVerifier(scheme, version.PublicKey)
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+// ImportLegacyKeys moves the private keys that devices created before the key provider still
+// carry into the key provider, and references them by handle instead. Keys that were encrypted at
+// rest are wrapped with the device ID and need the key-encryption key they were wrapped with,
+// wrapper may be nil if no key was encrypted. It returns the number of imported keys and is a
+// no-op once all keys have been imported, so it is safe to run at every start.
+func (s *DeviceService) ImportLegacyKeys(wrapper *crypt.KeyWrapper) (int, error) {
+	imported := 0
+	afterID := ""
+	for {
+		devices, err := s.store.List(persistence.ListFilter{AfterID: afterID, Limit: MaxPageSize})
+		if err != nil {
+			return imported, storeError(err)
+		}
+
+		for _, device := range devices {
+			if len(device.PrivateKey) == 0 {
+				continue
+			}
+			if err := s.importLegacyKey(device.ID, wrapper); err != nil {
+				return imported, fmt.Errorf("importing private key of device %s: %w", device.ID, err)
+			}
+			imported++
+		}
+
+		if len(devices) < MaxPageSize {
+			return imported, nil
+		}
+		afterID = devices[len(devices)-1].ID
+	}
+}
+
+// importLegacyKey imports the private key of a single device. The key is only removed from the
+// device in the same transaction that sets its handle, so it cannot get lost in between. The
+// transaction may run again, so the key is imported once and discarded if it ends up unused.
+func (s *DeviceService) importLegacyKey(deviceID string, wrapper *crypt.KeyWrapper) error {
+	var (
+		handle string
+		used   bool
+	)
+	operation := func(device *domain.SignatureDevice, _ persistence.Tx) error {
+		used = false
+		if len(device.PrivateKey) == 0 {
+			return nil // imported in the meantime
+		}
+		if device.KeyHandle != "" {
+			return errors.New("device has both a key handle and a private key")
+		}
+
+		privateKey := device.PrivateKey
+		if crypt.IsWrappedKey(privateKey) {
+			if wrapper == nil {
+				return errors.New("private key is encrypted, but no key-encryption key is configured")
+			}
+			var err error
+			if privateKey, err = wrapper.Unwrap(device.ID, privateKey); err != nil {
+				return err
+			}
+		}
+
+		if handle == "" {
+			var err error
+			if handle, err = s.keys.Import(device.Algorithm, privateKey); err != nil {
+				return err
+			}
+		}
+		device.KeyHandle = handle
+		device.PrivateKey = nil
+		used = true
+		return nil
+	}
+
+	if err := s.store.InTx(deviceID, operation); err != nil {
+		if handle != "" {
+			return s.discardKey(handle, storeError(err))
+		}
+		return storeError(err)
+	}
+	if handle != "" && !used {
+		if err := s.keys.Destroy(handle); err != nil {
+			return fmt.Errorf("destroying unused key %s: %w", handle, err)
+		}
+	}
+	return nil
+}
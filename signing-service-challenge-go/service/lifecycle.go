@@ -0,0 +1,157 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/keys"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+var (
+	ErrDeviceNotActive   = errors.New("device is not active")
+	ErrInvalidTransition = errors.New("invalid status transition")
+)
+
+// transitions lists the states a device can move to from each state.
+var transitions = map[string][]string{
+	domain.StatusActive:         {domain.StatusSuspended, domain.StatusDecommissioned},
+	domain.StatusSuspended:      {domain.StatusActive, domain.StatusDecommissioned},
+	domain.StatusDecommissioned: {},
+}
+
+// UpdateDeviceParams are the changes to a device, nil fields stay as they are.
+type UpdateDeviceParams struct {
+	Label  *string
+	Status *string
+}
+
+// DeviceStatus returns the lifecycle state of a device. Devices created before
+// states existed have none stored and are active.
+func DeviceStatus(device domain.SignatureDevice) string {
+	if device.Status == "" {
+		return domain.StatusActive
+	}
+	return device.Status
+}
+
+// UpdateDevice changes the label or the lifecycle state of a device. Setting the current state
+// again is allowed and changes nothing. Decommissioning destroys the private key, the public key
+// and the signatures are kept so the history can still be verified.
+func (s *DeviceService) UpdateDevice(id string, params UpdateDeviceParams) (domain.SignatureDevice, error) {
+	if params.Status != nil {
+		if _, exists := transitions[*params.Status]; !exists {
+			return domain.SignatureDevice{}, fmt.Errorf("%w: unknown status %q", ErrInvalidInput, *params.Status)
+		}
+	}
+
+	var updated domain.SignatureDevice
+	operation := func(device *domain.SignatureDevice, tx persistence.Tx) error {
+		if params.Status != nil {
+			if err := checkTransition(DeviceStatus(*device), *params.Status); err != nil {
+				return err
+			}
+			device.Status = *params.Status
+		}
+		if DeviceStatus(*device) == domain.StatusDecommissioned {
+			device.PrivateKey = nil
+		}
+		if params.Label != nil {
+			device.Label = *params.Label
+		}
+		updated = *device
+		return nil
+	}
+
+	if err := s.store.InTx(id, operation); err != nil {
+		return domain.SignatureDevice{}, storeError(err)
+	}
+
+	// The key is destroyed once the device is stored as decommissioned, so no signature can be
+	// created with it anymore. The device is decommissioned either way, if the key cannot be
+	// destroyed now, DestroyDecommissionedKeys retries it.
+	if DeviceStatus(updated) == domain.StatusDecommissioned && updated.KeyHandle != "" {
+		if err := s.destroyDecommissionedKey(updated.ID, updated.KeyHandle); err != nil {
+			log.Printf("Could not destroy the private key of decommissioned device %s: %v", updated.ID, err)
+		} else {
+			updated.KeyHandle = ""
+		}
+	}
+
+	return updated, nil
+}
+
+// DestroyDecommissionedKeys destroys the private keys that decommissioned devices still reference,
+// because destroying them failed when the devices were decommissioned. It returns the number of
+// destroyed keys and is a no-op if there are none, so it is safe to run at every start.
+func (s *DeviceService) DestroyDecommissionedKeys() (int, error) {
+	destroyed := 0
+	afterID := ""
+	for {
+		devices, err := s.store.List(persistence.ListFilter{AfterID: afterID, Limit: MaxPageSize})
+		if err != nil {
+			return destroyed, storeError(err)
+		}
+
+		for _, device := range devices {
+			if DeviceStatus(device) != domain.StatusDecommissioned || device.KeyHandle == "" {
+				continue
+			}
+			if err := s.destroyDecommissionedKey(device.ID, device.KeyHandle); err != nil {
+				return destroyed, fmt.Errorf("destroying private key of device %s: %w", device.ID, err)
+			}
+			destroyed++
+		}
+
+		if len(devices) < MaxPageSize {
+			return destroyed, nil
+		}
+		afterID = devices[len(devices)-1].ID
+	}
+}
+
+// destroyDecommissionedKey destroys the key of a decommissioned device and only then forgets its
+// handle, so that a key which could not be destroyed stays recorded on the device.
+func (s *DeviceService) destroyDecommissionedKey(deviceID string, handle string) error {
+	if err := s.keys.Destroy(handle); err != nil && !errors.Is(err, keys.ErrKeyNotFound) {
+		return err
+	}
+
+	operation := func(device *domain.SignatureDevice, _ persistence.Tx) error {
+		if device.KeyHandle == handle {
+			device.KeyHandle = ""
+		}
+		return nil
+	}
+	return storeError(s.store.InTx(deviceID, operation))
+}
+
+func checkTransition(from, to string) error {
+	if from == to {
+		return nil
+	}
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s devices can only become %s", ErrInvalidTransition, strings.ToLower(from), allowedTransitions(from))
+}
+
+func allowedTransitions(from string) string {
+	if len(transitions[from]) == 0 {
+		return "nothing else"
+	}
+	return strings.ToLower(strings.Join(transitions[from], " or "))
+}
+
+// checkActive returns ErrDeviceNotActive unless the device may use its private key.
+func checkActive(device domain.SignatureDevice) error {
+	if status := DeviceStatus(device); status != domain.StatusActive {
+		return fmt.Errorf("%w: device %s is %s", ErrDeviceNotActive, device.ID, strings.ToLower(status))
+	}
+	return nil
+}
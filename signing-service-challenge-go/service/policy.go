@@ -0,0 +1,100 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+)
+
+// KeyPolicy restricts the keys new devices may be created with.
+// Existing devices keep working regardless of the policy.
+type KeyPolicy struct {
+	MinKeySizes map[string]int // bits per algorithm, algorithms without entry are unrestricted
+}
+
+// DefaultKeyPolicy rejects RSA keys below 2048 bits and allows all supported curves.
+func DefaultKeyPolicy() KeyPolicy {
+	return KeyPolicy{
+		MinKeySizes: map[string]int{
+			domain.AlgorithmRSA: 2048,
+		},
+	}
+}
+
+// keySpec determines the key size and signature scheme a device is created with and checks them
+// against the policy. ECC keys can be selected by curve name as an alternative to their size.
+// A scheme that is bound to a key size, like ECDSA_P384_SHA384, selects that size too.
+func (p KeyPolicy) keySpec(params CreateDeviceParams) (keySize int, scheme string, err error) {
+	alg, err := crypt.LookupAlgorithm(params.Algorithm)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, params.Algorithm)
+	}
+
+	keySize = params.KeySize
+	if params.Curve != "" {
+		if alg.Name != domain.AlgorithmECC {
+			return 0, "", fmt.Errorf("%w: curve is only supported for %s", ErrInvalidInput, domain.AlgorithmECC)
+		}
+		curveSize, ok := curveSize(params.Curve)
+		if !ok {
+			return 0, "", fmt.Errorf("%w: unsupported curve %s", ErrInvalidInput, params.Curve)
+		}
+		if keySize != 0 && keySize != curveSize {
+			return 0, "", fmt.Errorf("%w: curve %s does not have %d bits", ErrInvalidInput, params.Curve, keySize)
+		}
+		keySize = curveSize
+	}
+
+	if params.Scheme != "" {
+		signatureScheme, err := crypt.LookupScheme(params.Scheme)
+		if err != nil || signatureScheme.Algorithm != alg.Name {
+			return 0, "", fmt.Errorf("%w: unsupported scheme %s for %s", ErrInvalidInput, params.Scheme, alg.Name)
+		}
+		if signatureScheme.KeySize != 0 {
+			if keySize != 0 && keySize != signatureScheme.KeySize {
+				return 0, "", fmt.Errorf("%w: scheme %s requires a key size of %d", ErrInvalidInput, params.Scheme, signatureScheme.KeySize)
+			}
+			keySize = signatureScheme.KeySize
+		}
+	}
+
+	if keySize == 0 {
+		keySize = alg.DefaultKeySize
+	}
+	if !slices.Contains(alg.KeySizes, keySize) {
+		return 0, "", fmt.Errorf("%w: unsupported key size %d, supported are %v", ErrInvalidInput, keySize, alg.KeySizes)
+	}
+	if minimum := p.MinKeySizes[alg.Name]; keySize < minimum {
+		return 0, "", fmt.Errorf("%w: key size %d is below the minimum of %d", ErrInvalidInput, keySize, minimum)
+	}
+
+	scheme = params.Scheme
+	if scheme == "" {
+		scheme = alg.DefaultScheme(keySize)
+	}
+	return keySize, scheme, nil
+}
+
+func curveSize(name string) (int, bool) {
+	for _, size := range crypt.ECCKeySizes {
+		if curve, err := crypt.ECCCurve(size); err == nil && curve.Params().Name == name {
+			return size, true
+		}
+	}
+	return 0, false
+}
+
+// CurveName returns the name of the curve of an ECC device, like "P-256",
+// or an empty string for other algorithms and devices of unknown key size.
+func CurveName(device domain.SignatureDevice) string {
+	if device.Algorithm != domain.AlgorithmECC {
+		return ""
+	}
+	curve, err := crypt.ECCCurve(device.KeySize)
+	if err != nil {
+		return ""
+	}
+	return curve.Params().Name
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+// PublicKey is a key version of a device, together with the scheme it signs with.
+type PublicKey struct {
+	DeviceID string
+	Version  int
+	Key      crypto.PublicKey
+	Scheme   crypt.SignatureScheme
+}
+
+// KeyID identifies the key version among the keys of all devices, like <device ID>#2.
+func (k PublicKey) KeyID() string {
+	return fmt.Sprintf("%s#%d", k.DeviceID, k.Version)
+}
+
+// GetPublicKey returns the decoded current public key of a device.
+func (s *DeviceService) GetPublicKey(deviceID string) (PublicKey, error) {
+	device, err := s.store.Get(deviceID)
+	if err != nil {
+		return PublicKey{}, storeError(err)
+	}
+	return versionPublicKey(device.ID, currentKeyVersion(device))
+}
+
+// ListPublicKeys returns the public keys of all active devices ordered by device ID and version.
+// Keys replaced by a rotation are included, as they verify the signatures created before.
+// A key that cannot be decoded is logged and left out, so it does not hide the keys of all others.
+func (s *DeviceService) ListPublicKeys() ([]PublicKey, error) {
+	publicKeys := make([]PublicKey, 0)
+	afterID := ""
+	for {
+		devices, err := s.store.List(persistence.ListFilter{AfterID: afterID, Limit: MaxPageSize})
+		if err != nil {
+			return nil, storeError(err)
+		}
+
+		for _, device := range devices {
+			if DeviceStatus(device) != domain.StatusActive {
+				continue
+			}
+			for _, version := range KeyVersions(device) {
+				publicKey, err := versionPublicKey(device.ID, version)
+				if err != nil {
+					log.Printf("Leaving out a public key: %v", err)
+					continue
+				}
+				publicKeys = append(publicKeys, publicKey)
+			}
+		}
+
+		if len(devices) < MaxPageSize {
+			return publicKeys, nil
+		}
+		afterID = devices[len(devices)-1].ID
+	}
+}
+
+func versionPublicKey(deviceID string, version domain.KeyVersion) (PublicKey, error) {
+	scheme, err := crypt.LookupScheme(version.Scheme)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("device %s: %w", deviceID, err)
+	}
+
+	key, err := crypt.DERMarshaler{}.DecodePublicKey(version.PublicKey)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("loading public key %d of device %s: %w", version.Version, deviceID, err)
+	}
+
+	return PublicKey{DeviceID: deviceID, Version: version.Version, Key: key, Scheme: scheme}, nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/keys"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+// ErrConcurrentRotation reports that the key of a device was rotated while it was being rotated.
+var ErrConcurrentRotation = errors.New("key was rotated concurrently")
+
+// RotateKey replaces the key of a device with a fresh key pair of the same algorithm, size and
+// scheme, for example when the old key is suspected to be compromised. The counter and the
+// signature chain continue, the new key signs from the current counter on. The old key signs the
+// new public key as a link between the two and is destroyed afterwards. Certificates are issued
+// for a key, so the device's certificate chain is removed.
+//
+// The new key is generated before the device is locked, as that can take long for RSA keys and
+// would hold up signing meanwhile.
+func (s *DeviceService) RotateKey(deviceID string) (domain.SignatureDevice, error) {
+	device, err := s.store.Get(deviceID)
+	if err != nil {
+		return domain.SignatureDevice{}, storeError(err)
+	}
+	if DeviceStatus(device) == domain.StatusDecommissioned {
+		return domain.SignatureDevice{}, fmt.Errorf("%w: device %s is decommissioned", ErrDeviceNotActive, device.ID)
+	}
+
+	current := currentKeyVersion(device)
+	keySize, err := rotationKeySize(device, current)
+	if err != nil {
+		return domain.SignatureDevice{}, err
+	}
+	newHandle, publicKey, err := s.generateKey(device.Algorithm, keySize)
+	if err != nil {
+		return domain.SignatureDevice{}, err
+	}
+
+	var (
+		rotated   domain.SignatureDevice
+		oldHandle string
+	)
+	operation := func(device *domain.SignatureDevice, tx persistence.Tx) error {
+		if DeviceStatus(*device) == domain.StatusDecommissioned {
+			return fmt.Errorf("%w: device %s is decommissioned", ErrDeviceNotActive, device.ID)
+		}
+		if currentKeyVersion(*device).Version != current.Version {
+			return fmt.Errorf("%w: device %s", ErrConcurrentRotation, device.ID)
+		}
+
+		link, err := s.keys.Sign(device.KeyHandle, current.Scheme, publicKey)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrSigningFailed, err)
+		}
+
+		// Copied, so a failed transaction cannot leave the new version in the stored device.
+		versions := append([]domain.KeyVersion(nil), KeyVersions(*device)...)
+		device.KeyVersions = append(versions, domain.KeyVersion{
+			Version:       current.Version + 1,
+			PublicKey:     publicKey,
+			KeySize:       keySize,
+			Scheme:        current.Scheme,
+			FromCounter:   device.SignatureCounter,
+			LinkSignature: base64.StdEncoding.EncodeToString(link),
+			CreatedAt:     time.Now().UTC(),
+		})
+
+		oldHandle = device.KeyHandle
+		device.KeyHandle = newHandle
+		device.PublicKey = publicKey
+		device.KeySize = keySize
+		device.CertificateChain = nil
+		rotated = *device
+		return nil
+	}
+
+	if err := s.store.InTx(deviceID, operation); err != nil {
+		return domain.SignatureDevice{}, s.discardKey(newHandle, storeError(err))
+	}
+
+	if err := s.keys.Destroy(oldHandle); err != nil && !errors.Is(err, keys.ErrKeyNotFound) {
+		return rotated, fmt.Errorf("destroying previous key: %w", err)
+	}
+
+	return rotated, nil
+}
+
+// rotationKeySize returns the size of the current key, which the new key gets as well.
+// Devices created before key sizes were recorded use the default of their algorithm.
+func rotationKeySize(device domain.SignatureDevice, current domain.KeyVersion) (int, error) {
+	if current.KeySize != 0 {
+		return current.KeySize, nil
+	}
+
+	alg, err := crypt.LookupAlgorithm(device.Algorithm)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, device.Algorithm)
+	}
+	return alg.DefaultKeySize, nil
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+)
+
+// Versions of the secured data format, which defines the bytes a device actually signs.
+const (
+	// SecuredDataV1 is <signature_counter>_<data_to_be_signed>_<last_signature_base64_encoded>.
+	// It only fits text, and it cannot be split into its parts if the data contains underscores.
+	SecuredDataV1 = 1
+	// SecuredDataV2 frames every part with its length, see encodeV2. As it is binary,
+	// signed data of this version is base64 encoded.
+	SecuredDataV2 = 2
+)
+
+// Payload types of SecuredDataV2. Digests are "DIGEST:" followed by the hash, like DIGEST:SHA256.
+const (
+	payloadData         = "DATA"
+	payloadDigestPrefix = "DIGEST:"
+)
+
+var errMalformedSecuredData = errors.New("malformed secured data")
+
+// securedData is what a signature covers, independently of the format it is encoded in.
+type securedData struct {
+	Version       int
+	Counter       uint64
+	PayloadType   string // payloadData, or the digest prefix and hash for a digest
+	Payload       []byte
+	LastSignature string // base64 encoded signature the data chains to
+}
+
+// SecuredDataFormat returns the version of the secured data format a signature was created with.
+func SecuredDataFormat(signature domain.Signature) int {
+	if signature.DataFormat == 0 {
+		return SecuredDataV1 // the only format before the version was recorded
+	}
+	return signature.DataFormat
+}
+
+// encode returns the signed data as it is recorded and the message that is signed.
+func (d securedData) encode() (string, []byte) {
+	if d.Version == SecuredDataV1 {
+		signedData := fmt.Sprintf("%d_%s_%s", d.Counter, d.Payload, d.LastSignature)
+		return signedData, []byte(signedData)
+	}
+
+	message := d.encodeV2()
+	return base64.StdEncoding.EncodeToString(message), message
+}
+
+// encodeV2 lays out SecuredDataV2:
+//
+//	version         uint8, always 2
+//	counter         uint64, big endian
+//	payload type    uint32 length, big endian, followed by as many bytes
+//	payload         uint32 length, big endian, followed by as many bytes
+//	last signature  uint32 length, big endian, followed by as many bytes
+func (d securedData) encodeV2() []byte {
+	var buffer bytes.Buffer
+	buffer.WriteByte(SecuredDataV2)
+	binary.Write(&buffer, binary.BigEndian, d.Counter)
+	for _, field := range [][]byte{[]byte(d.PayloadType), d.Payload, []byte(d.LastSignature)} {
+		binary.Write(&buffer, binary.BigEndian, uint32(len(field)))
+		buffer.Write(field)
+	}
+	return buffer.Bytes()
+}
+
+// decodeV2 parses the message of SecuredDataV2, the inverse of encodeV2.
+func decodeV2(message []byte) (securedData, error) {
+	reader := bytes.NewReader(message)
+	version, err := reader.ReadByte()
+	if err != nil || version != SecuredDataV2 {
+		return securedData{}, fmt.Errorf("%w: not version %d", errMalformedSecuredData, SecuredDataV2)
+	}
+
+	d := securedData{Version: SecuredDataV2}
+	if err := binary.Read(reader, binary.BigEndian, &d.Counter); err != nil {
+		return securedData{}, fmt.Errorf("%w: truncated counter", errMalformedSecuredData)
+	}
+
+	var fields [3][]byte
+	for i := range fields {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil || int64(length) > int64(reader.Len()) {
+			return securedData{}, fmt.Errorf("%w: truncated field", errMalformedSecuredData)
+		}
+		fields[i] = make([]byte, length)
+		reader.Read(fields[i])
+	}
+	if reader.Len() > 0 {
+		return securedData{}, fmt.Errorf("%w: trailing bytes", errMalformedSecuredData)
+	}
+
+	d.PayloadType, d.Payload, d.LastSignature = string(fields[0]), fields[1], string(fields[2])
+	return d, nil
+}
+
+// signedMessage returns the message a signature covers, given the signed data in its format.
+func signedMessage(format int, signedData string) ([]byte, error) {
+	switch format {
+	case SecuredDataV1:
+		return []byte(signedData), nil
+	case SecuredDataV2:
+		message, err := base64.StdEncoding.DecodeString(signedData)
+		if err != nil {
+			return nil, fmt.Errorf("%w: not valid base64", errMalformedSecuredData)
+		}
+		return message, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown secured data format %d", ErrInvalidInput, format)
+	}
+}
+
+// signedCounter returns the signature counter the secured data starts with.
+func signedCounter(format int, signedData string) (uint64, bool) {
+	if format == SecuredDataV2 {
+		message, err := signedMessage(format, signedData)
+		if err != nil || len(message) < 9 || message[0] != SecuredDataV2 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint64(message[1:9]), true
+	}
+
+	prefix, _, found := strings.Cut(signedData, "_")
+	if !found {
+		return 0, false
+	}
+	counter, err := strconv.ParseUint(prefix, 10, 64)
+	return counter, err == nil
+}
+
+// checkChained checks that a signature's secured data has its counter and links to the previous
+// signature. It returns the reason if not.
+func checkChained(signature domain.Signature, previous string) string {
+	format := SecuredDataFormat(signature)
+	if format == SecuredDataV1 {
+		if !strings.HasPrefix(signature.SignedData, fmt.Sprintf("%d_", signature.Counter)) {
+			return "signed data does not start with the signature counter"
+		}
+		if !strings.HasSuffix(signature.SignedData, "_"+previous) {
+			return "signed data does not link to the previous signature"
+		}
+		return ""
+	}
+
+	message, err := signedMessage(format, signature.SignedData)
+	if err != nil {
+		return err.Error()
+	}
+	d, err := decodeV2(message)
+	if err != nil {
+		return err.Error()
+	}
+	if d.Counter != signature.Counter {
+		return "signed data does not have the signature counter"
+	}
+	if d.LastSignature != previous {
+		return "signed data does not link to the previous signature"
+	}
+	return ""
+}
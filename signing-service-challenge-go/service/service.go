@@ -0,0 +1,119 @@
+// Package service implements the signing service's use cases independently of any transport.
+// The HTTP handlers in package api are thin adapters over it.
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/keys"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+
+	DefaultIdempotencyRetention = 24 * time.Hour
+	DefaultMaxBatchSize         = 1000
+)
+
+var (
+	ErrInvalidInput         = errors.New("invalid input")
+	ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+	ErrDeviceNotFound       = errors.New("device not found")
+	ErrDeviceExists         = errors.New("device already exists")
+	ErrSignatureNotFound    = errors.New("signature not found")
+)
+
+// Config holds the settings of a DeviceService.
+type Config struct {
+	KeyPolicy KeyPolicy
+	// IdempotencyRetention is how long a signing request can be retried with the same
+	// idempotency key. 0 means DefaultIdempotencyRetention.
+	IdempotencyRetention time.Duration
+	// MaxBatchSize is the most transactions SignBatch signs at once. 0 means DefaultMaxBatchSize.
+	MaxBatchSize int
+}
+
+// DefaultConfig returns the default settings, with DefaultKeyPolicy.
+func DefaultConfig() Config {
+	return Config{
+		KeyPolicy:            DefaultKeyPolicy(),
+		IdempotencyRetention: DefaultIdempotencyRetention,
+		MaxBatchSize:         DefaultMaxBatchSize,
+	}
+}
+
+// DeviceService manages signature devices and the transactions they sign.
+// The devices are kept in store, their private keys in the key provider.
+type DeviceService struct {
+	store     persistence.DeviceStore
+	keys      keys.KeyProvider
+	keyPolicy KeyPolicy
+
+	idempotencyRetention time.Duration
+	maxBatchSize         int
+}
+
+func NewDeviceService(store persistence.DeviceStore, keyProvider keys.KeyProvider, config Config) *DeviceService {
+	if config.IdempotencyRetention == 0 {
+		config.IdempotencyRetention = DefaultIdempotencyRetention
+	}
+	if config.MaxBatchSize == 0 {
+		config.MaxBatchSize = DefaultMaxBatchSize
+	}
+
+	return &DeviceService{
+		store:                store,
+		keys:                 keyProvider,
+		keyPolicy:            config.KeyPolicy,
+		idempotencyRetention: config.IdempotencyRetention,
+		maxBatchSize:         config.MaxBatchSize,
+	}
+}
+
+// MaxBatchSize returns the most transactions SignBatch signs at once.
+func (s *DeviceService) MaxBatchSize() int {
+	return s.maxBatchSize
+}
+
+// storeError translates the errors of the store into the errors of this package.
+func storeError(err error) error {
+	switch {
+	case errors.Is(err, persistence.ErrDeviceNotFound):
+		return ErrDeviceNotFound
+	case errors.Is(err, persistence.ErrDeviceExists):
+		return ErrDeviceExists
+	case errors.Is(err, persistence.ErrSignatureNotFound):
+		return ErrSignatureNotFound
+	default:
+		return err
+	}
+}
+
+// pageLimit applies the default and maximum page size.
+func pageLimit(limit int) (int, error) {
+	if limit == 0 {
+		return DefaultPageSize, nil
+	}
+	if limit < 1 || limit > MaxPageSize {
+		return 0, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidInput, MaxPageSize)
+	}
+	return limit, nil
+}
+
+// encodeCursor hides the paging key from clients, so it can change without breaking them.
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid cursor", ErrInvalidInput)
+	}
+	return string(key), nil
+}
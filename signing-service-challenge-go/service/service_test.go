@@ -0,0 +1,685 @@
+package service_test
+
+import (
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/keys"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/schema"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/service"
+)
+
+func newService(t *testing.T) *service.DeviceService {
+	t.Helper()
+	devices := newServiceWithPolicy(t, service.DefaultKeyPolicy())
+	_, _, err := devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC})
+	require.NoError(t, err)
+	return devices
+}
+
+func newServiceWithPolicy(t *testing.T, policy service.KeyPolicy) *service.DeviceService {
+	t.Helper()
+	token, err := keys.NewSoftToken("", nil)
+	require.NoError(t, err)
+	return service.NewDeviceService(persistence.NewInMemoryDeviceStore(), token, service.Config{KeyPolicy: policy})
+}
+
+func TestCreateDevice(t *testing.T) {
+	devices := newService(t)
+
+	_, _, err := devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000002", Algorithm: "DSA"})
+	assert.ErrorIs(t, err, service.ErrUnsupportedAlgorithm)
+
+	_, err = devices.GetDevice("unknown")
+	assert.ErrorIs(t, err, service.ErrDeviceNotFound)
+
+	t.Run("Generated ID", func(t *testing.T) {
+		device, created, err := devices.CreateDevice(service.CreateDeviceParams{Algorithm: domain.AlgorithmECC})
+		require.NoError(t, err)
+		assert.True(t, created)
+		id, err := uuid.Parse(device.ID)
+		require.NoError(t, err)
+		assert.Equal(t, uuid.Version(7), id.Version())
+	})
+
+	t.Run("Invalid IDs", func(t *testing.T) {
+		for _, id := range []string{"device-1", "00000000-0000-0000-0000-000000000000", "0192D4E0-7B5C-7C4E-9B3A-5F0E2D1C4B6A", "{0192d4e0-7b5c-7c4e-9b3a-5f0e2d1c4b6a}"} {
+			_, _, err := devices.CreateDevice(service.CreateDeviceParams{ID: id, Algorithm: domain.AlgorithmECC})
+			assert.ErrorIs(t, err, service.ErrInvalidInput, id)
+		}
+	})
+
+	t.Run("Repeated create", func(t *testing.T) {
+		existing, err := devices.GetDevice("00000000-0000-4000-8000-000000000001")
+		require.NoError(t, err)
+
+		device, created, err := devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC})
+		require.NoError(t, err)
+		assert.False(t, created)
+		assert.Equal(t, existing, device)
+
+		// The label may have been changed since the device was created.
+		device, created, err = devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC, Label: "Till 1"})
+		require.NoError(t, err)
+		assert.False(t, created)
+		assert.Equal(t, existing, device)
+
+		_, _, err = devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC, Curve: "P-256"})
+		assert.ErrorIs(t, err, service.ErrDeviceExists)
+		_, _, err = devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmRSA})
+		assert.ErrorIs(t, err, service.ErrDeviceExists)
+	})
+
+	t.Run("Repeated create of a device without key size", func(t *testing.T) {
+		store := persistence.NewInMemoryDeviceStore()
+		token, err := keys.NewSoftToken("", nil)
+		require.NoError(t, err)
+		devices := service.NewDeviceService(store, token, service.DefaultConfig())
+		require.NoError(t, store.Create(domain.SignatureDevice{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC}))
+
+		_, created, err := devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC})
+		require.NoError(t, err)
+		assert.False(t, created)
+		_, _, err = devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC, Curve: "P-256"})
+		assert.ErrorIs(t, err, service.ErrDeviceExists)
+	})
+}
+
+func TestCreateDeviceKeySpec(t *testing.T) {
+	tests := []struct {
+		name            string
+		params          service.CreateDeviceParams
+		expectedKeySize int
+		expectedScheme  string
+		expectedErr     error
+	}{
+		{name: "ECC default", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmECC}, expectedKeySize: 384, expectedScheme: "ECDSA_P384_SHA256"},
+		{name: "ECC by curve", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmECC, Curve: "P-256"}, expectedKeySize: 256},
+		{name: "ECC by size", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmECC, KeySize: 521}, expectedKeySize: 521},
+		{name: "RSA default", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmRSA}, expectedKeySize: 2048, expectedScheme: "RSA_PKCS1_SHA256"},
+		{name: "RSA-PSS", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmRSA, Scheme: "RSA_PSS_SHA512"}, expectedKeySize: 2048, expectedScheme: "RSA_PSS_SHA512"},
+		{name: "ECC by scheme", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmECC, Scheme: "ECDSA_P521_SHA512"}, expectedKeySize: 521, expectedScheme: "ECDSA_P521_SHA512"},
+		{name: "Scheme and size disagree", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmECC, Scheme: "ECDSA_P256_SHA256", KeySize: 384}, expectedErr: service.ErrInvalidInput},
+		{name: "Scheme of other algorithm", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmECC, Scheme: "RSA_PSS_SHA256"}, expectedErr: service.ErrInvalidInput},
+		{name: "Unknown curve", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmECC, Curve: "P-224"}, expectedErr: service.ErrInvalidInput},
+		{name: "Curve and size disagree", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmECC, Curve: "P-256", KeySize: 384}, expectedErr: service.ErrInvalidInput},
+		{name: "Curve for RSA", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmRSA, Curve: "P-256"}, expectedErr: service.ErrInvalidInput},
+		{name: "RSA below minimum", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmRSA, KeySize: 512}, expectedErr: service.ErrInvalidInput},
+		{name: "Unsupported RSA size", params: service.CreateDeviceParams{Algorithm: domain.AlgorithmRSA, KeySize: 2000}, expectedErr: service.ErrInvalidInput},
+	}
+
+	devices := newServiceWithPolicy(t, service.DefaultKeyPolicy())
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.ID = fmt.Sprintf("00000000-0000-4000-8000-%012d", i)
+			device, _, err := devices.CreateDevice(tt.params)
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedKeySize, device.KeySize)
+			if tt.expectedScheme != "" {
+				assert.Equal(t, tt.expectedScheme, device.Scheme)
+			}
+		})
+	}
+
+	t.Run("Policy can allow smaller keys", func(t *testing.T) {
+		devices := newServiceWithPolicy(t, service.KeyPolicy{MinKeySizes: map[string]int{domain.AlgorithmRSA: 1024}})
+		device, _, err := devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmRSA, KeySize: 1024})
+		require.NoError(t, err)
+		assert.Equal(t, 1024, device.KeySize)
+	})
+}
+
+func TestSignTransaction(t *testing.T) {
+	devices := newService(t)
+
+	first, err := devices.SignTransaction("00000000-0000-4000-8000-000000000001", "first")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), first.Counter)
+	assert.Equal(t, "ECDSA_P384_SHA256", first.Scheme)
+	assert.Equal(t, "0_first_"+base64.StdEncoding.EncodeToString([]byte("00000000-0000-4000-8000-000000000001")), first.SignedData)
+
+	second, err := devices.SignTransaction("00000000-0000-4000-8000-000000000001", "second")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), second.Counter)
+	assert.Equal(t, "1_second_"+first.Signature, second.SignedData)
+
+	device, err := devices.GetDevice("00000000-0000-4000-8000-000000000001")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), device.SignatureCounter)
+	assert.Equal(t, second.Signature, device.LastSignature)
+
+	result, err := devices.VerifySignature("00000000-0000-4000-8000-000000000001", service.VerifyParams{SignedData: second.SignedData, Signature: second.Signature})
+	require.NoError(t, err)
+	assert.True(t, result.Valid)
+
+	audit, err := devices.AuditChain("00000000-0000-4000-8000-000000000001")
+	require.NoError(t, err)
+	assert.True(t, audit.Valid)
+	assert.Equal(t, uint64(2), audit.Checked)
+
+	_, err = devices.SignTransaction("00000000-0000-4000-8000-000000000001", "")
+	assert.ErrorIs(t, err, service.ErrInvalidInput)
+
+	_, err = devices.SignTransaction("unknown", "data")
+	assert.ErrorIs(t, err, service.ErrDeviceNotFound)
+}
+
+// failingKeys fails the signature with the given data.
+type failingKeys struct {
+	keys.KeyProvider
+	failOn string
+}
+
+func (k failingKeys) Sign(handle string, scheme string, data []byte) ([]byte, error) {
+	if strings.Contains(string(data), k.failOn) {
+		return nil, errors.New("token removed")
+	}
+	return k.KeyProvider.Sign(handle, scheme, data)
+}
+
+func TestSignModes(t *testing.T) {
+	devices := newService(t)
+	id := "00000000-0000-4000-8000-000000000001"
+	digest := sha256.Sum256([]byte("receipt"))
+
+	// parseV2 splits secured data of version 2 into its length-prefixed fields.
+	parseV2 := func(t *testing.T, signedData string) (uint64, []string) {
+		t.Helper()
+		message, err := base64.StdEncoding.DecodeString(signedData)
+		require.NoError(t, err)
+		require.Equal(t, byte(service.SecuredDataV2), message[0])
+		counter := binary.BigEndian.Uint64(message[1:9])
+		var fields []string
+		for rest := message[9:]; len(rest) > 0; {
+			length := binary.BigEndian.Uint32(rest)
+			fields = append(fields, string(rest[4:4+length]))
+			rest = rest[4+length:]
+		}
+		return counter, fields
+	}
+
+	text, err := devices.Sign(id, service.SignParams{DataToBeSigned: "a_b"})
+	require.NoError(t, err)
+	assert.Equal(t, service.SecuredDataV1, text.DataFormat)
+
+	binaryData, err := devices.Sign(id, service.SignParams{DataToBeSigned: base64.StdEncoding.EncodeToString([]byte{0, '_', 0xff}), Encoding: service.EncodingBase64})
+	require.NoError(t, err)
+	assert.Equal(t, service.SecuredDataV2, binaryData.DataFormat)
+	counter, fields := parseV2(t, binaryData.SignedData)
+	assert.Equal(t, uint64(1), counter)
+	assert.Equal(t, []string{"DATA", "\x00_\xff", text.Signature}, fields)
+
+	hashed, err := devices.Sign(id, service.SignParams{Digest: base64.StdEncoding.EncodeToString(digest[:]), DigestAlgorithm: "SHA256"})
+	require.NoError(t, err)
+	_, fields = parseV2(t, hashed.SignedData)
+	assert.Equal(t, []string{"DIGEST:SHA256", string(digest[:]), binaryData.Signature}, fields)
+
+	framedText, err := devices.Sign(id, service.SignParams{DataToBeSigned: "a_b", SecuredDataFormat: service.SecuredDataV2})
+	require.NoError(t, err)
+	_, fields = parseV2(t, framedText.SignedData)
+	assert.Equal(t, "a_b", fields[1])
+
+	for _, signature := range []domain.Signature{text, binaryData, hashed, framedText} {
+		result, err := devices.VerifySignature(id, service.VerifyParams{SignedData: signature.SignedData, Signature: signature.Signature, SecuredDataFormat: signature.DataFormat})
+		require.NoError(t, err)
+		assert.True(t, result.Valid, result.Reason)
+	}
+	result, err := devices.VerifySignature(id, service.VerifyParams{SignedData: hashed.SignedData, Signature: hashed.Signature})
+	require.NoError(t, err)
+	assert.False(t, result.Valid, "the format must match")
+
+	audit, err := devices.AuditChain(id)
+	require.NoError(t, err)
+	assert.True(t, audit.Valid, audit.Reason)
+	assert.Equal(t, uint64(4), audit.Checked)
+
+	for name, params := range map[string]service.SignParams{
+		"Invalid base64":           {DataToBeSigned: "not base64!", Encoding: service.EncodingBase64},
+		"Unknown encoding":         {DataToBeSigned: "data", Encoding: "hex"},
+		"Binary in version 1":      {DataToBeSigned: "AA==", Encoding: service.EncodingBase64, SecuredDataFormat: service.SecuredDataV1},
+		"Unknown format":           {DataToBeSigned: "data", SecuredDataFormat: 3},
+		"Digest and data":          {DataToBeSigned: "data", Digest: base64.StdEncoding.EncodeToString(digest[:]), DigestAlgorithm: "SHA256"},
+		"Digest of wrong length":   {Digest: base64.StdEncoding.EncodeToString(digest[:]), DigestAlgorithm: "SHA512"},
+		"Unknown digest algorithm": {Digest: base64.StdEncoding.EncodeToString(digest[:]), DigestAlgorithm: "MD5"},
+	} {
+		_, err := devices.Sign(id, params)
+		assert.ErrorIs(t, err, service.ErrInvalidInput, name)
+	}
+}
+
+func TestTransactionSchema(t *testing.T) {
+	devices := newServiceWithPolicy(t, service.DefaultKeyPolicy())
+	id := "00000000-0000-4000-8000-000000000001"
+	_, _, err := devices.CreateDevice(service.CreateDeviceParams{ID: id, Algorithm: domain.AlgorithmECC, TransactionSchema: schema.Receipt})
+	require.NoError(t, err)
+
+	_, _, err = devices.CreateDevice(service.CreateDeviceParams{Algorithm: domain.AlgorithmECC, TransactionSchema: "INVOICE"})
+	assert.ErrorIs(t, err, service.ErrInvalidInput)
+
+	receipt, err := devices.Sign(id, service.SignParams{DataToBeSigned: `{
+		"vat_lines": [{"vat": 1.90, "net": 10, "rate": 19}],
+		"timestamp": "2024-05-01T12:00:00Z", "currency": "EUR", "amount": 11.90
+	}`})
+	require.NoError(t, err)
+	canonical := `{"amount":11.90,"currency":"EUR","timestamp":"2024-05-01T12:00:00Z","vat_lines":[{"net":10,"rate":19,"vat":1.90}]}`
+	assert.Equal(t, "0_"+canonical+"_"+base64.StdEncoding.EncodeToString([]byte(id)), receipt.SignedData)
+
+	_, err = devices.Sign(id, service.SignParams{DataToBeSigned: `{"amount": 11.9, "currency": "euro"}`})
+	var transactionErr *service.TransactionError
+	require.ErrorAs(t, err, &transactionErr)
+	assert.ErrorIs(t, err, service.ErrInvalidTransaction)
+	assert.Equal(t, []schema.FieldError{
+		{Field: "currency", Message: "must match ^[A-Z]{3}$"},
+		{Field: "timestamp", Message: "is required"},
+		{Field: "vat_lines", Message: "is required"},
+	}, transactionErr.Fields)
+
+	_, err = devices.Sign(id, service.SignParams{DataToBeSigned: "receipt"})
+	assert.ErrorAs(t, err, &transactionErr)
+
+	digest := sha256.Sum256([]byte(canonical))
+	_, err = devices.Sign(id, service.SignParams{Digest: base64.StdEncoding.EncodeToString(digest[:]), DigestAlgorithm: "SHA256"})
+	assert.ErrorIs(t, err, service.ErrInvalidInput)
+
+	_, err = devices.SignBatch(id, []service.SignParams{{DataToBeSigned: canonical}, {DataToBeSigned: `{}`}})
+	require.ErrorAs(t, err, &transactionErr)
+	assert.Equal(t, "[1].amount", transactionErr.Fields[0].Field)
+
+	device, err := devices.GetDevice(id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), device.SignatureCounter)
+	assert.Equal(t, schema.Receipt, device.TransactionSchema)
+}
+
+func TestSignBatch(t *testing.T) {
+	token, err := keys.NewSoftToken("", nil)
+	require.NoError(t, err)
+	config := service.DefaultConfig()
+	config.MaxBatchSize = 3
+	devices := service.NewDeviceService(persistence.NewInMemoryDeviceStore(), failingKeys{KeyProvider: token, failOn: "poison"}, config)
+	id := "00000000-0000-4000-8000-000000000001"
+	_, _, err = devices.CreateDevice(service.CreateDeviceParams{ID: id, Algorithm: domain.AlgorithmECC})
+	require.NoError(t, err)
+
+	batch := func(data ...string) []service.SignParams {
+		params := make([]service.SignParams, 0, len(data))
+		for _, d := range data {
+			params = append(params, service.SignParams{DataToBeSigned: d})
+		}
+		return params
+	}
+
+	signatures, err := devices.SignBatch(id, batch("a", "b", "c"))
+	require.NoError(t, err)
+	require.Len(t, signatures, 3)
+	for i, signature := range signatures {
+		assert.Equal(t, uint64(i), signature.Counter)
+	}
+	assert.Equal(t, "1_b_"+signatures[0].Signature, signatures[1].SignedData)
+
+	for name, params := range map[string][]service.SignParams{
+		"Empty batch":     nil,
+		"Too large":       batch("a", "b", "c", "d"),
+		"Empty data":      batch("a", ""),
+		"Signing fails":   batch("a", "poison"),
+		"Idempotency key": {{DataToBeSigned: "a", IdempotencyKey: "retry-1"}},
+	} {
+		_, err := devices.SignBatch(id, params)
+		assert.Error(t, err, name)
+	}
+
+	// None of the failed batches signed anything.
+	device, err := devices.GetDevice(id)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), device.SignatureCounter)
+	assert.Equal(t, signatures[2].Signature, device.LastSignature)
+
+	audit, err := devices.AuditChain(id)
+	require.NoError(t, err)
+	assert.True(t, audit.Valid)
+
+	suspended := domain.StatusSuspended
+	_, err = devices.UpdateDevice(id, service.UpdateDeviceParams{Status: &suspended})
+	require.NoError(t, err)
+	_, err = devices.SignBatch(id, batch("a"))
+	assert.ErrorIs(t, err, service.ErrDeviceNotActive)
+}
+
+func TestSignIdempotency(t *testing.T) {
+	devices := newService(t)
+	params := service.SignParams{DataToBeSigned: "receipt", IdempotencyKey: "retry-1"}
+
+	first, err := devices.Sign("00000000-0000-4000-8000-000000000001", params)
+	require.NoError(t, err)
+	retry, err := devices.Sign("00000000-0000-4000-8000-000000000001", params)
+	require.NoError(t, err)
+	assert.Equal(t, first, retry)
+
+	device, err := devices.GetDevice("00000000-0000-4000-8000-000000000001")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), device.SignatureCounter)
+
+	_, err = devices.Sign("00000000-0000-4000-8000-000000000001", service.SignParams{DataToBeSigned: "other", IdempotencyKey: "retry-1"})
+	assert.ErrorIs(t, err, service.ErrIdempotencyKeyReused)
+
+	// Keys are per device.
+	_, _, err = devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000002", Algorithm: domain.AlgorithmECC})
+	require.NoError(t, err)
+	other, err := devices.Sign("00000000-0000-4000-8000-000000000002", params)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), other.Counter)
+
+	_, err = devices.Sign("00000000-0000-4000-8000-000000000001", service.SignParams{DataToBeSigned: "receipt", IdempotencyKey: strings.Repeat("k", service.MaxIdempotencyKeyLength+1)})
+	assert.ErrorIs(t, err, service.ErrInvalidInput)
+
+	t.Run("Expired keys sign again", func(t *testing.T) {
+		token, err := keys.NewSoftToken("", nil)
+		require.NoError(t, err)
+		config := service.DefaultConfig()
+		config.IdempotencyRetention = time.Millisecond
+		devices := service.NewDeviceService(persistence.NewInMemoryDeviceStore(), token, config)
+		_, _, err = devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC})
+		require.NoError(t, err)
+
+		first, err := devices.Sign("00000000-0000-4000-8000-000000000001", params)
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+		second, err := devices.Sign("00000000-0000-4000-8000-000000000001", service.SignParams{DataToBeSigned: "other", IdempotencyKey: "retry-1"})
+		require.NoError(t, err)
+		assert.Equal(t, first.Counter+1, second.Counter)
+	})
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	token, err := keys.NewSoftToken("", nil)
+	require.NoError(t, err)
+	devices := service.NewDeviceService(persistence.NewInMemoryDeviceStore(), token, service.DefaultConfig())
+	created, _, err := devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC})
+	require.NoError(t, err)
+	assert.Equal(t, domain.StatusActive, created.Status)
+	signature, err := devices.SignTransaction("00000000-0000-4000-8000-000000000001", "first")
+	require.NoError(t, err)
+
+	status := func(status string) service.UpdateDeviceParams {
+		return service.UpdateDeviceParams{Status: &status}
+	}
+
+	t.Run("Suspended devices do not sign", func(t *testing.T) {
+		device, err := devices.UpdateDevice("00000000-0000-4000-8000-000000000001", status(domain.StatusSuspended))
+		require.NoError(t, err)
+		assert.Equal(t, domain.StatusSuspended, device.Status)
+
+		_, err = devices.SignTransaction("00000000-0000-4000-8000-000000000001", "data")
+		assert.ErrorIs(t, err, service.ErrDeviceNotActive)
+		_, err = devices.CreateCertificateRequest("00000000-0000-4000-8000-000000000001", service.CertificateParams{})
+		assert.ErrorIs(t, err, service.ErrDeviceNotActive)
+
+		_, err = devices.UpdateDevice("00000000-0000-4000-8000-000000000001", status(domain.StatusActive))
+		require.NoError(t, err)
+		_, err = devices.SignTransaction("00000000-0000-4000-8000-000000000001", "second")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Label", func(t *testing.T) {
+		label := "Till 1"
+		device, err := devices.UpdateDevice("00000000-0000-4000-8000-000000000001", service.UpdateDeviceParams{Label: &label})
+		require.NoError(t, err)
+		assert.Equal(t, "Till 1", device.Label)
+		assert.Equal(t, domain.StatusActive, device.Status, "status must not change")
+	})
+
+	t.Run("Decommissioning destroys the key", func(t *testing.T) {
+		device, err := devices.UpdateDevice("00000000-0000-4000-8000-000000000001", status(domain.StatusDecommissioned))
+		require.NoError(t, err)
+		assert.Equal(t, domain.StatusDecommissioned, device.Status)
+		assert.Empty(t, device.KeyHandle)
+		assert.Equal(t, created.PublicKey, device.PublicKey)
+		_, err = token.PublicKey(created.KeyHandle)
+		assert.ErrorIs(t, err, keys.ErrKeyNotFound)
+
+		_, err = devices.SignTransaction("00000000-0000-4000-8000-000000000001", "data")
+		assert.ErrorIs(t, err, service.ErrDeviceNotActive)
+
+		result, err := devices.VerifySignature("00000000-0000-4000-8000-000000000001", service.VerifyParams{SignedData: signature.SignedData, Signature: signature.Signature})
+		require.NoError(t, err)
+		assert.True(t, result.Valid, "signatures must still verify")
+		audit, err := devices.AuditChain("00000000-0000-4000-8000-000000000001")
+		require.NoError(t, err)
+		assert.True(t, audit.Valid)
+		assert.Equal(t, uint64(2), audit.Checked)
+	})
+
+	t.Run("Transitions", func(t *testing.T) {
+		_, err := devices.UpdateDevice("00000000-0000-4000-8000-000000000001", status(domain.StatusDecommissioned))
+		assert.NoError(t, err, "setting the current status again is allowed")
+		_, err = devices.UpdateDevice("00000000-0000-4000-8000-000000000001", status(domain.StatusActive))
+		assert.ErrorIs(t, err, service.ErrInvalidTransition)
+		_, err = devices.UpdateDevice("00000000-0000-4000-8000-000000000001", status(domain.StatusSuspended))
+		assert.ErrorIs(t, err, service.ErrInvalidTransition)
+		_, err = devices.UpdateDevice("00000000-0000-4000-8000-000000000001", status("DELETED"))
+		assert.ErrorIs(t, err, service.ErrInvalidInput)
+		_, err = devices.UpdateDevice("unknown", status(domain.StatusSuspended))
+		assert.ErrorIs(t, err, service.ErrDeviceNotFound)
+	})
+}
+
+// undestroyableKeys fails to destroy keys.
+type undestroyableKeys struct {
+	keys.KeyProvider
+}
+
+func (undestroyableKeys) Destroy(string) error {
+	return errors.New("token removed")
+}
+
+func TestDecommissionWithoutDestroyingKey(t *testing.T) {
+	token, err := keys.NewSoftToken("", nil)
+	require.NoError(t, err)
+	store := persistence.NewInMemoryDeviceStore()
+	devices := service.NewDeviceService(store, undestroyableKeys{token}, service.DefaultConfig())
+	_, _, err = devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmECC})
+	require.NoError(t, err)
+
+	decommissioned := domain.StatusDecommissioned
+	updated, err := devices.UpdateDevice("00000000-0000-4000-8000-000000000001", service.UpdateDeviceParams{Status: &decommissioned})
+	require.NoError(t, err)
+	assert.Equal(t, domain.StatusDecommissioned, updated.Status)
+
+	// The device is decommissioned and still references the key, until it is destroyed.
+	device, err := store.Get("00000000-0000-4000-8000-000000000001")
+	require.NoError(t, err)
+	assert.Equal(t, domain.StatusDecommissioned, device.Status)
+	assert.NotEmpty(t, device.KeyHandle)
+	_, err = devices.SignTransaction("00000000-0000-4000-8000-000000000001", "data")
+	assert.ErrorIs(t, err, service.ErrDeviceNotActive)
+
+	_, err = devices.DestroyDecommissionedKeys()
+	assert.ErrorContains(t, err, "token removed")
+
+	destroyed, err := service.NewDeviceService(store, token, service.DefaultConfig()).DestroyDecommissionedKeys()
+	require.NoError(t, err)
+	assert.Equal(t, 1, destroyed)
+	_, err = token.PublicKey(device.KeyHandle)
+	assert.ErrorIs(t, err, keys.ErrKeyNotFound)
+	device, err = store.Get("00000000-0000-4000-8000-000000000001")
+	require.NoError(t, err)
+	assert.Empty(t, device.KeyHandle)
+}
+
+func TestRotateKey(t *testing.T) {
+	token, err := keys.NewSoftToken("", nil)
+	require.NoError(t, err)
+	store := persistence.NewInMemoryDeviceStore()
+	devices := service.NewDeviceService(store, token, service.DefaultConfig())
+	created, _, err := devices.CreateDevice(service.CreateDeviceParams{ID: "00000000-0000-4000-8000-000000000001", Algorithm: domain.AlgorithmRSA, Scheme: "RSA_PSS_SHA256"})
+	require.NoError(t, err)
+	_, err = devices.IssueSelfSignedCertificate("00000000-0000-4000-8000-000000000001", service.CertificateParams{})
+	require.NoError(t, err)
+
+	var signatures []domain.Signature
+	for _, data := range []string{"first", "second"} {
+		signature, err := devices.SignTransaction("00000000-0000-4000-8000-000000000001", data)
+		require.NoError(t, err)
+		signatures = append(signatures, signature)
+	}
+
+	rotated, err := devices.RotateKey("00000000-0000-4000-8000-000000000001")
+	require.NoError(t, err)
+	assert.NotEqual(t, created.PublicKey, rotated.PublicKey)
+	assert.NotEqual(t, created.KeyHandle, rotated.KeyHandle)
+	assert.Equal(t, uint64(2), rotated.SignatureCounter, "counter must continue")
+	assert.Empty(t, rotated.CertificateChain, "certificate of the old key must be removed")
+	require.Len(t, rotated.KeyVersions, 2)
+	next := rotated.KeyVersions[1]
+	assert.Equal(t, 2, next.Version)
+	assert.Equal(t, uint64(2), next.FromCounter)
+	assert.Equal(t, "RSA_PSS_SHA256", next.Scheme)
+	assert.Equal(t, 2048, next.KeySize)
+
+	_, err = token.PublicKey(created.KeyHandle)
+	assert.ErrorIs(t, err, keys.ErrKeyNotFound, "old key must be destroyed")
+
+	t.Run("Link signature", func(t *testing.T) {
+		scheme, err := crypt.LookupScheme("RSA_PSS_SHA256")
+		require.NoError(t, err)
+		verifier, err := crypt.NewVerifier(scheme, created.PublicKey)
+		require.NoError(t, err)
+		link, err := base64.StdEncoding.DecodeString(next.LinkSignature)
+		require.NoError(t, err)
+		assert.NoError(t, verifier.Verify(next.PublicKey, link))
+	})
+
+	for _, data := range []string{"third", "fourth"} {
+		signature, err := devices.SignTransaction("00000000-0000-4000-8000-000000000001", data)
+		require.NoError(t, err)
+		signatures = append(signatures, signature)
+	}
+
+	t.Run("Signatures verify with the key of their counter", func(t *testing.T) {
+		for i, signature := range signatures {
+			expectedVersion := 1
+			if i >= 2 {
+				expectedVersion = 2
+			}
+			assert.Equal(t, expectedVersion, signature.KeyVersion)
+
+			result, err := devices.VerifySignature("00000000-0000-4000-8000-000000000001", service.VerifyParams{SignedData: signature.SignedData, Signature: signature.Signature})
+			require.NoError(t, err)
+			assert.True(t, result.Valid, "signature %d: %s", i, result.Reason)
+		}
+
+		audit, err := devices.AuditChain("00000000-0000-4000-8000-000000000001")
+		require.NoError(t, err)
+		assert.True(t, audit.Valid, audit.Reason)
+		assert.Equal(t, uint64(4), audit.Checked)
+	})
+
+	t.Run("Broken link", func(t *testing.T) {
+		require.NoError(t, store.InTx("00000000-0000-4000-8000-000000000001", func(d *domain.SignatureDevice, tx persistence.Tx) error {
+			d.KeyVersions = append([]domain.KeyVersion(nil), d.KeyVersions...)
+			d.KeyVersions[1].LinkSignature = signatures[0].Signature
+			return nil
+		}))
+
+		audit, err := devices.AuditChain("00000000-0000-4000-8000-000000000001")
+		require.NoError(t, err)
+		assert.False(t, audit.Valid)
+		require.NotNil(t, audit.BrokenCounter)
+		assert.Equal(t, uint64(2), *audit.BrokenCounter)
+	})
+
+	t.Run("Decommissioned devices cannot rotate", func(t *testing.T) {
+		status := domain.StatusDecommissioned
+		_, err := devices.UpdateDevice("00000000-0000-4000-8000-000000000001", service.UpdateDeviceParams{Status: &status})
+		require.NoError(t, err)
+		_, err = devices.RotateKey("00000000-0000-4000-8000-000000000001")
+		assert.ErrorIs(t, err, service.ErrDeviceNotActive)
+		_, err = devices.RotateKey("unknown")
+		assert.ErrorIs(t, err, service.ErrDeviceNotFound)
+	})
+}
+
+func TestImportLegacyKeys(t *testing.T) {
+	store := persistence.NewInMemoryDeviceStore()
+	token, err := keys.NewSoftToken("", nil)
+	require.NoError(t, err)
+	devices := service.NewDeviceService(store, token, service.Config{})
+
+	kek := make([]byte, crypt.KEKSize)
+	wrapper, err := crypt.NewKeyWrapper(kek)
+	require.NoError(t, err)
+
+	// Devices as they were stored before the key provider: ECC keys as SEC1 with the raw public
+	// point, RSA keys as PKCS#1, and with a KEK wrapped with the device ID.
+	eccKey, err := (&crypt.ECCGenerator{}).Generate()
+	require.NoError(t, err)
+	eccPrivate, err := x509.MarshalECPrivateKey(eccKey.Private)
+	require.NoError(t, err)
+	rsaKey, err := (&crypt.RSAGenerator{}).Generate()
+	require.NoError(t, err)
+	rsaPublic, err := x509.MarshalPKIXPublicKey(rsaKey.Public)
+	require.NoError(t, err)
+	rsaPrivate, err := wrapper.Wrap("00000000-0000-4000-8000-000000000002", x509.MarshalPKCS1PrivateKey(rsaKey.Private))
+	require.NoError(t, err)
+
+	legacy := []domain.SignatureDevice{
+		{
+			ID:         "00000000-0000-4000-8000-000000000001",
+			Algorithm:  domain.AlgorithmECC,
+			PublicKey:  elliptic.Marshal(eccKey.Public.Curve, eccKey.Public.X, eccKey.Public.Y),
+			PrivateKey: eccPrivate,
+		},
+		{
+			ID:         "00000000-0000-4000-8000-000000000002",
+			Algorithm:  domain.AlgorithmRSA,
+			PublicKey:  rsaPublic,
+			PrivateKey: rsaPrivate,
+		},
+	}
+	for _, device := range legacy {
+		require.NoError(t, store.Create(device))
+	}
+
+	_, err = devices.ImportLegacyKeys(nil)
+	assert.ErrorContains(t, err, "no key-encryption key")
+
+	imported, err := devices.ImportLegacyKeys(wrapper)
+	require.NoError(t, err)
+	assert.Equal(t, 1, imported, "the ECC key was imported by the first attempt")
+
+	for _, device := range legacy {
+		stored, err := store.Get(device.ID)
+		require.NoError(t, err)
+		assert.Empty(t, stored.PrivateKey)
+		assert.NotEmpty(t, stored.KeyHandle)
+		assert.Equal(t, device.PublicKey, stored.PublicKey)
+
+		signature, err := devices.SignTransaction(device.ID, "receipt")
+		require.NoError(t, err)
+		result, err := devices.VerifySignature(device.ID, service.VerifyParams{SignedData: signature.SignedData, Signature: signature.Signature})
+		require.NoError(t, err)
+		assert.True(t, result.Valid, device.Algorithm)
+	}
+
+	imported, err = devices.ImportLegacyKeys(wrapper)
+	require.NoError(t, err)
+	assert.Zero(t, imported)
+}
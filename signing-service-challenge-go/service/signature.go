@@ -0,0 +1,372 @@
+package service
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+// MaxIdempotencyKeyLength limits the idempotency keys clients can send, UUIDs fit easily.
+const MaxIdempotencyKeyLength = 255
+
+var (
+	ErrSigningFailed        = errors.New("signing failed")
+	ErrIdempotencyKeyReused = errors.New("idempotency key was already used for another request")
+)
+
+// errReplayed aborts the transaction of a request that was already signed.
+var errReplayed = errors.New("request was already signed")
+
+// Encodings of SignParams.DataToBeSigned.
+const (
+	EncodingText   = "text"
+	EncodingBase64 = "base64"
+)
+
+// digestAlgorithms are the hashes a client may compute the digest of a transaction with.
+var digestAlgorithms = map[string]crypto.Hash{
+	"SHA256": crypto.SHA256,
+	"SHA384": crypto.SHA384,
+	"SHA512": crypto.SHA512,
+}
+
+// SignParams describe a transaction to sign.
+type SignParams struct {
+	DataToBeSigned string
+	Encoding       string // EncodingText (default) or EncodingBase64 for binary data
+	// Digest is the base64 encoded hash of the transaction, computed by the client with
+	// DigestAlgorithm (SHA256, SHA384 or SHA512). It is signed instead of DataToBeSigned.
+	Digest          string
+	DigestAlgorithm string
+	// SecuredDataFormat is the version of the secured data that is signed. 0 means SecuredDataV1
+	// for text and SecuredDataV2 for binary data and digests, which version 1 cannot hold.
+	SecuredDataFormat int
+	// IdempotencyKey identifies the request, so a retry with the same key gets the signature of
+	// the first attempt instead of a second one. Empty if the client does not retry.
+	IdempotencyKey string
+}
+
+// requestHash fingerprints everything that influences the signature except the idempotency key.
+func (p SignParams) requestHash() string {
+	request, _ := json.Marshal(struct {
+		DataToBeSigned    string `json:"data_to_be_signed"`
+		Encoding          string `json:"encoding,omitempty"`
+		Digest            string `json:"digest,omitempty"`
+		DigestAlgorithm   string `json:"digest_algorithm,omitempty"`
+		SecuredDataFormat int    `json:"secured_data_format,omitempty"`
+	}{p.DataToBeSigned, p.Encoding, p.Digest, p.DigestAlgorithm, p.SecuredDataFormat})
+	hash := sha256.Sum256(request)
+	return hex.EncodeToString(hash[:])
+}
+
+// securedData validates the transaction and returns the secured data for it,
+// without the counter and last signature, which are only known when signing.
+func (p SignParams) securedData() (securedData, error) {
+	d := securedData{Version: p.SecuredDataFormat, PayloadType: payloadData}
+	text := p.Encoding == "" || p.Encoding == EncodingText
+
+	switch {
+	case p.Digest != "":
+		if p.DataToBeSigned != "" {
+			return securedData{}, fmt.Errorf("%w: either data_to_be_signed or digest is required, not both", ErrInvalidInput)
+		}
+		hash, supported := digestAlgorithms[p.DigestAlgorithm]
+		if !supported {
+			return securedData{}, fmt.Errorf("%w: digest_algorithm must be SHA256, SHA384 or SHA512", ErrInvalidInput)
+		}
+		digest, err := base64.StdEncoding.DecodeString(p.Digest)
+		if err != nil || len(digest) != hash.Size() {
+			return securedData{}, fmt.Errorf("%w: digest must be a base64 encoded %s hash of %d bytes", ErrInvalidInput, p.DigestAlgorithm, hash.Size())
+		}
+		d.PayloadType = payloadDigestPrefix + p.DigestAlgorithm
+		d.Payload = digest
+		text = false
+
+	case p.DataToBeSigned == "":
+		return securedData{}, fmt.Errorf("%w: data_to_be_signed is required", ErrInvalidInput)
+
+	case text:
+		d.Payload = []byte(p.DataToBeSigned)
+
+	case p.Encoding == EncodingBase64:
+		data, err := base64.StdEncoding.DecodeString(p.DataToBeSigned)
+		if err != nil {
+			return securedData{}, fmt.Errorf("%w: data_to_be_signed is not valid base64", ErrInvalidInput)
+		}
+		d.Payload = data
+
+	default:
+		return securedData{}, fmt.Errorf("%w: encoding must be %s or %s", ErrInvalidInput, EncodingText, EncodingBase64)
+	}
+
+	switch {
+	case d.Version == 0 && text:
+		d.Version = SecuredDataV1
+	case d.Version == 0 || d.Version == SecuredDataV2:
+		d.Version = SecuredDataV2
+	case d.Version == SecuredDataV1 && !text:
+		return securedData{}, fmt.Errorf("%w: secured data format %d only supports text", ErrInvalidInput, SecuredDataV1)
+	case d.Version != SecuredDataV1:
+		return securedData{}, fmt.Errorf("%w: secured_data_format must be %d or %d", ErrInvalidInput, SecuredDataV1, SecuredDataV2)
+	}
+
+	return d, nil
+}
+
+type ListSignaturesParams struct {
+	Cursor string // from SignaturePage.NextCursor, empty for the first page
+	Limit  int    // 0 means DefaultPageSize
+}
+
+type SignaturePage struct {
+	Signatures []domain.Signature
+	NextCursor string // empty on the last page
+}
+
+// SignTransaction creates the next signature in the device's chain and records it
+// atomically with the counter increment.
+func (s *DeviceService) SignTransaction(deviceID string, dataToBeSigned string) (domain.Signature, error) {
+	return s.Sign(deviceID, SignParams{DataToBeSigned: dataToBeSigned})
+}
+
+// Sign is SignTransaction with an optional idempotency key. The key is stored atomically with the
+// signature, so of concurrent retries only one signs. A retry within the retention window gets
+// the original signature back, ErrIdempotencyKeyReused if it does not match the original request.
+func (s *DeviceService) Sign(deviceID string, params SignParams) (domain.Signature, error) {
+	secured, err := params.securedData()
+	if err != nil {
+		return domain.Signature{}, err
+	}
+	if len(params.IdempotencyKey) > MaxIdempotencyKeyLength {
+		return domain.Signature{}, fmt.Errorf("%w: idempotency key must not be longer than %d characters", ErrInvalidInput, MaxIdempotencyKeyLength)
+	}
+	requestHash := params.requestHash()
+
+	// The schema of a device never changes, so the transaction is checked before the device is locked.
+	device, err := s.store.Get(deviceID)
+	if err != nil {
+		return domain.Signature{}, storeError(err)
+	}
+	if err := canonicalTransaction(device, &secured); err != nil {
+		return domain.Signature{}, err
+	}
+
+	var signature domain.Signature
+	operation := func(device *domain.SignatureDevice, tx persistence.Tx) error {
+		if params.IdempotencyKey != "" {
+			original, found, err := s.replay(device.ID, params.IdempotencyKey, requestHash)
+			if err != nil {
+				return err
+			}
+			if found {
+				signature = original
+				return errReplayed
+			}
+		}
+
+		if err := checkActive(*device); err != nil {
+			return err
+		}
+
+		var err error
+		signature, err = s.signNext(device, tx, secured)
+		if err != nil {
+			return err
+		}
+
+		if params.IdempotencyKey != "" {
+			tx.ExpireIdempotencyKeys(signature.CreatedAt.Add(-s.idempotencyRetention))
+			tx.PutIdempotencyKey(domain.IdempotencyKey{
+				DeviceID:    device.ID,
+				Key:         params.IdempotencyKey,
+				RequestHash: requestHash,
+				Counter:     signature.Counter,
+				CreatedAt:   signature.CreatedAt,
+			})
+		}
+		return nil
+	}
+
+	if err := s.store.InTx(deviceID, operation); err != nil && !errors.Is(err, errReplayed) {
+		return domain.Signature{}, storeError(err)
+	}
+
+	return signature, nil
+}
+
+// SignBatch signs the transactions in order under a single lock of the device, so their signatures
+// get consecutive counters. Either all of them are signed or, if one fails, none.
+// Idempotency keys are not supported for batches.
+func (s *DeviceService) SignBatch(deviceID string, batch []SignParams) ([]domain.Signature, error) {
+	if len(batch) == 0 {
+		return nil, fmt.Errorf("%w: the batch is empty", ErrInvalidInput)
+	}
+	if len(batch) > s.maxBatchSize {
+		return nil, fmt.Errorf("%w: a batch must not have more than %d transactions", ErrInvalidInput, s.maxBatchSize)
+	}
+	transactions := make([]securedData, 0, len(batch))
+	for i, params := range batch {
+		secured, err := params.securedData()
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
+		if params.IdempotencyKey != "" {
+			return nil, fmt.Errorf("%w: transaction %d: idempotency keys are not supported in batches", ErrInvalidInput, i)
+		}
+		transactions = append(transactions, secured)
+	}
+
+	device, err := s.store.Get(deviceID)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	for i := range transactions {
+		err := canonicalTransaction(device, &transactions[i])
+		var transactionErr *TransactionError
+		if errors.As(err, &transactionErr) {
+			return nil, transactionErr.inBatch(i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("transaction %d: %w", i, err)
+		}
+	}
+
+	var signatures []domain.Signature
+	operation := func(device *domain.SignatureDevice, tx persistence.Tx) error {
+		if err := checkActive(*device); err != nil {
+			return err
+		}
+
+		signatures = make([]domain.Signature, 0, len(transactions))
+		for i, secured := range transactions {
+			signature, err := s.signNext(device, tx, secured)
+			if err != nil {
+				return fmt.Errorf("transaction %d: %w", i, err)
+			}
+			signatures = append(signatures, signature)
+		}
+		return nil
+	}
+
+	if err := s.store.InTx(deviceID, operation); err != nil {
+		return nil, storeError(err)
+	}
+
+	return signatures, nil
+}
+
+// signNext creates the device's next signature over the checked transaction and advances its chain.
+func (s *DeviceService) signNext(device *domain.SignatureDevice, tx persistence.Tx, secured securedData) (domain.Signature, error) {
+	secured.Counter = device.SignatureCounter
+	secured.LastSignature = getLastSignature(*device)
+	signedData, message := secured.encode()
+
+	scheme := DeviceScheme(*device)
+	signatureBytes, err := s.keys.Sign(device.KeyHandle, scheme, message)
+	if err != nil {
+		return domain.Signature{}, fmt.Errorf("%w: %v", ErrSigningFailed, err)
+	}
+
+	signature := domain.Signature{
+		DeviceID:   device.ID,
+		Counter:    secured.Counter,
+		Signature:  base64.StdEncoding.EncodeToString(signatureBytes),
+		Scheme:     scheme,
+		KeyVersion: currentKeyVersion(*device).Version,
+		DataFormat: secured.Version,
+		SignedData: signedData,
+		CreatedAt:  time.Now().UTC(),
+	}
+	device.LastSignature = signature.Signature
+	device.SignatureCounter += 1
+	tx.AddSignature(signature)
+	return signature, nil
+}
+
+// replay returns the signature created for an earlier request with the idempotency key.
+// Keys older than the retention window are ignored, they are replaced by the new request.
+func (s *DeviceService) replay(deviceID string, key string, requestHash string) (domain.Signature, bool, error) {
+	record, err := s.store.GetIdempotencyKey(deviceID, key)
+	if errors.Is(err, persistence.ErrIdempotencyKeyNotFound) {
+		return domain.Signature{}, false, nil
+	}
+	if err != nil {
+		return domain.Signature{}, false, err
+	}
+	if time.Since(record.CreatedAt) > s.idempotencyRetention {
+		return domain.Signature{}, false, nil
+	}
+	if record.RequestHash != requestHash {
+		return domain.Signature{}, false, ErrIdempotencyKeyReused
+	}
+
+	signature, err := s.store.GetSignature(deviceID, record.Counter)
+	if err != nil {
+		return domain.Signature{}, false, err
+	}
+	return signature, true, nil
+}
+
+// GetSignature returns the signature a device created at the given counter.
+func (s *DeviceService) GetSignature(deviceID string, counter uint64) (domain.Signature, error) {
+	signature, err := s.store.GetSignature(deviceID, counter)
+	if err != nil {
+		return domain.Signature{}, storeError(err)
+	}
+	return signature, nil
+}
+
+// ListSignatures pages through the signature history of a device, ordered by counter.
+func (s *DeviceService) ListSignatures(deviceID string, params ListSignaturesParams) (SignaturePage, error) {
+	limit, err := pageLimit(params.Limit)
+	if err != nil {
+		return SignaturePage{}, err
+	}
+
+	var fromCounter uint64
+	if params.Cursor != "" {
+		key, err := decodeCursor(params.Cursor)
+		if err != nil {
+			return SignaturePage{}, err
+		}
+		fromCounter, err = strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return SignaturePage{}, fmt.Errorf("%w: invalid cursor", ErrInvalidInput)
+		}
+	}
+
+	signatures, err := s.store.ListSignatures(deviceID, persistence.SignatureFilter{
+		FromCounter: fromCounter,
+		Limit:       limit + 1,
+	})
+	if err != nil {
+		return SignaturePage{}, storeError(err)
+	}
+
+	page := SignaturePage{Signatures: signatures}
+	if len(signatures) > limit {
+		page.Signatures = signatures[:limit]
+		page.NextCursor = encodeCursor(strconv.FormatUint(signatures[limit].Counter, 10))
+	}
+
+	return page, nil
+}
+
+// getLastSignature returns the signature the next one chains to. The first signature
+// of a device chains to the base64 encoded device ID instead.
+func getLastSignature(device domain.SignatureDevice) string {
+	if device.LastSignature == "" {
+		return base64.StdEncoding.EncodeToString([]byte(device.ID))
+	}
+
+	return device.LastSignature
+}
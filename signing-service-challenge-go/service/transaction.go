@@ -0,0 +1,81 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/schema"
+)
+
+var ErrInvalidTransaction = errors.New("transaction does not match the schema")
+
+// TransactionError lists the fields of a transaction that violate the device's schema.
+type TransactionError struct {
+	Fields []schema.FieldError // path of the field like vat_lines[0].rate, in batches like [1].vat_lines[0].rate
+}
+
+func (e *TransactionError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		fields = append(fields, field.String())
+	}
+	return fmt.Sprintf("%v: %s", ErrInvalidTransaction, strings.Join(fields, "; "))
+}
+
+func (e *TransactionError) Unwrap() error {
+	return ErrInvalidTransaction
+}
+
+// inBatch prefixes the fields with the index of the transaction in a batch, like [1].amount.
+func (e *TransactionError) inBatch(index int) *TransactionError {
+	batchErr := &TransactionError{Fields: make([]schema.FieldError, 0, len(e.Fields))}
+	for _, field := range e.Fields {
+		path := fmt.Sprintf("[%d]", index)
+		if field.Field != "" {
+			path += "." + field.Field
+		}
+		batchErr.Fields = append(batchErr.Fields, schema.FieldError{Field: path, Message: field.Message})
+	}
+	return batchErr
+}
+
+// lookupTransactionSchema checks that a device can be bound to the schema.
+func lookupTransactionSchema(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, err := schema.Lookup(name); err != nil {
+		return fmt.Errorf("%w: transaction_schema must be one of %s", ErrInvalidInput, strings.Join(schema.Names(), ", "))
+	}
+	return nil
+}
+
+// canonicalTransaction validates the payload of the secured data against the device's schema and
+// replaces it with its canonical form, so that the signed data does not depend on the key order
+// or the whitespace of the transaction.
+// Devices without a schema sign the payload as it is.
+func canonicalTransaction(device domain.SignatureDevice, secured *securedData) error {
+	if device.TransactionSchema == "" {
+		return nil
+	}
+	transactionSchema, err := schema.Lookup(device.TransactionSchema)
+	if err != nil {
+		return err
+	}
+	if secured.PayloadType != payloadData {
+		return fmt.Errorf("%w: device %s only signs %s transactions, not digests", ErrInvalidInput, device.ID, device.TransactionSchema)
+	}
+
+	canonical, transaction, err := schema.Canonicalize(secured.Payload)
+	if err != nil {
+		return &TransactionError{Fields: []schema.FieldError{{Message: "must be a JSON document: " + err.Error()}}}
+	}
+	if fields := transactionSchema.Validate(transaction); len(fields) > 0 {
+		return &TransactionError{Fields: fields}
+	}
+
+	secured.Payload = canonical
+	return nil
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/crypt"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/domain"
+	"github.com/zdevaty/fiskaly-coding-challenges/signing-service-challenge/persistence"
+)
+
+// VerificationResult tells whether a signature is valid and, if not, why.
+type VerificationResult struct {
+	Valid  bool
+	Reason string
+}
+
+// ChainAudit is the result of checking a device's whole signature chain.
+type ChainAudit struct {
+	Valid         bool
+	Checked       uint64  // number of signatures verified successfully
+	BrokenCounter *uint64 // first counter that is missing or does not verify
+	Reason        string
+}
+
+// VerifyParams describe a signature to verify.
+type VerifyParams struct {
+	SignedData        string
+	Signature         string // base64 encoded
+	SecuredDataFormat int    // version of the format of SignedData, 0 means SecuredDataV1
+}
+
+// VerifySignature checks a single signature against the device's public key. If the device key was
+// rotated, the key that was current at the counter the signed data starts with is used.
+func (s *DeviceService) VerifySignature(deviceID string, params VerifyParams) (VerificationResult, error) {
+	if params.SignedData == "" || params.Signature == "" {
+		return VerificationResult{}, fmt.Errorf("%w: signed_data and signature are required", ErrInvalidInput)
+	}
+	format := params.SecuredDataFormat
+	if format == 0 {
+		format = SecuredDataV1
+	}
+
+	device, err := s.GetDevice(deviceID)
+	if err != nil {
+		return VerificationResult{}, err
+	}
+
+	message, err := signedMessage(format, params.SignedData)
+	if errors.Is(err, ErrInvalidInput) {
+		return VerificationResult{}, err
+	}
+	if err != nil {
+		return VerificationResult{Valid: false, Reason: err.Error()}, nil
+	}
+
+	version := currentKeyVersion(device)
+	if counter, ok := signedCounter(format, params.SignedData); ok {
+		version = keyVersionAt(device, counter)
+	}
+
+	verifier, err := newVerifier(version)
+	if err != nil {
+		return VerificationResult{}, fmt.Errorf("loading public key: %w", err)
+	}
+
+	if err := verifySignature(verifier, message, params.Signature); err != nil {
+		return VerificationResult{Valid: false, Reason: err.Error()}, nil
+	}
+	return VerificationResult{Valid: true}, nil
+}
+
+// AuditChain walks all signatures of a device in counter order and checks that each one
+// is present, links to its predecessor and verifies against the device key of its counter range.
+// Rotated keys must be linked by a signature of the previous key.
+func (s *DeviceService) AuditChain(deviceID string) (ChainAudit, error) {
+	device, err := s.GetDevice(deviceID)
+	if err != nil {
+		return ChainAudit{}, err
+	}
+
+	verifiers, err := keyVersionVerifiers(device)
+	if err != nil {
+		return ChainAudit{}, fmt.Errorf("loading public key: %w", err)
+	}
+
+	var counter uint64
+	previous := base64.StdEncoding.EncodeToString([]byte(device.ID))
+	broken := func(reason string) ChainAudit {
+		brokenCounter := counter
+		return ChainAudit{Checked: counter, BrokenCounter: &brokenCounter, Reason: reason}
+	}
+
+	versions := KeyVersions(device)
+	for i := 1; i < len(versions); i++ {
+		link, err := base64.StdEncoding.DecodeString(versions[i].LinkSignature)
+		if err == nil {
+			err = verifiers[versions[i-1].Version].Verify(versions[i].PublicKey, link)
+		}
+		if err != nil {
+			brokenCounter := versions[i].FromCounter
+			reason := fmt.Sprintf("key version %d is not linked to version %d: %v", versions[i].Version, versions[i-1].Version, err)
+			return ChainAudit{BrokenCounter: &brokenCounter, Reason: reason}, nil
+		}
+	}
+
+	for counter < device.SignatureCounter {
+		signatures, err := s.store.ListSignatures(device.ID, persistence.SignatureFilter{
+			FromCounter: counter,
+			Limit:       MaxPageSize,
+		})
+		if err != nil {
+			return ChainAudit{}, storeError(err)
+		}
+		if len(signatures) == 0 {
+			return broken("signature is missing"), nil
+		}
+
+		for _, signature := range signatures {
+			if counter == device.SignatureCounter {
+				break
+			}
+			if signature.Counter != counter {
+				return broken("signature is missing"), nil
+			}
+			if reason := checkChained(signature, previous); reason != "" {
+				return broken(reason), nil
+			}
+			version := keyVersionAt(device, counter)
+			if signature.KeyVersion != 0 && signature.KeyVersion != version.Version {
+				return broken(fmt.Sprintf("signature names key version %d, but version %d signs this counter", signature.KeyVersion, version.Version)), nil
+			}
+			message, err := signedMessage(SecuredDataFormat(signature), signature.SignedData)
+			if err != nil {
+				return broken(err.Error()), nil
+			}
+			if err := verifySignature(verifiers[version.Version], message, signature.Signature); err != nil {
+				return broken(err.Error()), nil
+			}
+			previous = signature.Signature
+			counter++
+		}
+	}
+
+	if device.SignatureCounter > 0 && device.LastSignature != previous {
+		counter = device.SignatureCounter - 1
+		return broken("last signature of the device does not match the chain"), nil
+	}
+
+	return ChainAudit{Valid: true, Checked: counter}, nil
+}
+
+// keyVersionVerifiers returns a verifier for each key version of a device.
+func keyVersionVerifiers(device domain.SignatureDevice) (map[int]crypt.Verifier, error) {
+	verifiers := make(map[int]crypt.Verifier)
+	for _, version := range KeyVersions(device) {
+		verifier, err := newVerifier(version)
+		if err != nil {
+			return nil, fmt.Errorf("key version %d: %w", version.Version, err)
+		}
+		verifiers[version.Version] = verifier
+	}
+	return verifiers, nil
+}
+
+func verifySignature(verifier crypt.Verifier, message []byte, encodedSignature string) error {
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return fmt.Errorf("%w: not valid base64", crypt.ErrMalformedSignature)
+	}
+	return verifier.Verify(message, signature)
+}